@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/poolqa/CgbiPngFix/ipaPng"
+)
+
+// batchOptions controls where batch mode writes its outputs.
+type batchOptions struct {
+	outDir   string       // mirror the input tree below this directory
+	template string       // or name each output with this template
+	suffix   string       // or write each output next to its input, with this added to the name
+	failFast bool         // stop at the first file that fails
+	noSort   bool         // process files in directory order instead of sorted
+	maxFiles int          // give up if there are more input files than this, 0 for no limit
+	fetches  int          // url inputs of a list fetched at once
+	ext      string       // replace the extension of outputs in outDir, if set
+	report   *errorReport // also record failures here, if set
+}
+
+// findPngFiles walks dir and returns the path of every .png file below it.
+// With sorted the list is in lexicographic order, for reproducible runs,
+// otherwise in whatever order the filesystem lists directories. The walk
+// is aborted as soon as more than maxFiles files turned up, unless
+// maxFiles is 0.
+func findPngFiles(dir string, sorted bool, maxFiles int) ([]string, error) {
+	var files []string
+	add := func(path string) error {
+		if !isPngName(path) {
+			return nil
+		}
+		if maxFiles > 0 && len(files) == maxFiles {
+			return tooManyFiles(maxFiles)
+		}
+		files = append(files, path)
+		return nil
+	}
+	if sorted {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			return add(path)
+		})
+		sort.Strings(files)
+		return files, err
+	}
+	err := walkUnsorted(dir, add)
+	return files, err
+}
+
+// errNoInputs is the error of a run that found no png to convert, which
+// exits with exitNothing so that scripts notice a wrong path.
+var errNoInputs = errors.New("no png files to convert")
+
+// tooManyFiles is the error of a run over the -max-files limit.
+func tooManyFiles(maxFiles int) error {
+	return fmt.Errorf("more than %d input files, raise -max-files if that is intended", maxFiles)
+}
+
+// isPngName reports whether path has a .png extension, in any case.
+func isPngName(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".png")
+}
+
+// walkUnsorted calls fn for every file below dir, skipping the sorting
+// filepath.Walk does for each directory. An error of fn stops the walk.
+func walkUnsorted(dir string, fn func(path string) error) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := walkUnsorted(path, fn); err != nil {
+				return err
+			}
+		} else if err := fn(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandTemplate builds an output path for input from tmpl. {dir} is the
+// directory of input, {name} its base name without extension and {ext} its
+// extension without the leading dot.
+func expandTemplate(tmpl string, input string) (string, error) {
+	ext := filepath.Ext(input)
+	values := map[string]string{
+		"dir":  filepath.Dir(input),
+		"name": strings.TrimSuffix(filepath.Base(input), ext),
+		"ext":  strings.TrimPrefix(ext, "."),
+	}
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in template %q", tmpl)
+		}
+		key := tmpl[start+1 : start+end]
+		value, ok := values[key]
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder {%v} in template", key)
+		}
+		out.WriteString(tmpl[:start])
+		out.WriteString(value)
+		tmpl = tmpl[start+end+1:]
+	}
+	out.WriteString(tmpl)
+	return filepath.Clean(out.String()), nil
+}
+
+// outputPaths maps every input file to its output path and makes sure no
+// two inputs end up at the same place. Inputs below dir keep their relative
+// path in bo.outDir; without dir only their base name is kept.
+func outputPaths(dir string, files []string, bo batchOptions, co convertOptions) ([]string, error) {
+	outputs := make([]string, len(files))
+	seen := make(map[string]string, len(files))
+	inputs := make(map[string]bool, len(files))
+	for _, input := range files {
+		inputs[filepath.Clean(input)] = true
+	}
+	for i, input := range files {
+		var output string
+		if bo.suffix != "" {
+			ext := filepath.Ext(input)
+			if bo.ext != "" {
+				output = strings.TrimSuffix(input, ext) + bo.suffix + bo.ext
+			} else {
+				output = strings.TrimSuffix(input, ext) + bo.suffix + ext
+			}
+			output = filepath.Clean(output)
+		} else if bo.template != "" {
+			var err error
+			if output, err = expandTemplate(bo.template, input); err != nil {
+				return nil, err
+			}
+		} else {
+			rel := filepath.Base(input)
+			if dir != "" {
+				var err error
+				if rel, err = filepath.Rel(dir, input); err != nil {
+					return nil, err
+				}
+			}
+			output = filepath.Join(bo.outDir, rel)
+			if bo.ext != "" {
+				output = strings.TrimSuffix(output, filepath.Ext(output)) + bo.ext
+			}
+		}
+		if output == filepath.Clean(input) {
+			return nil, fmt.Errorf("%v would be overwritten by its own output", input)
+		}
+		if inputs[output] {
+			return nil, fmt.Errorf("%v would be overwritten by the output of %v", output, input)
+		}
+		// With -suffix-dims the sizes may still tell outputs apart;
+		// doCgbiToPng checks the final names.
+		if prev, ok := seen[output]; ok && !co.suffixDims {
+			return nil, fmt.Errorf("%v and %v would both be written to %v", prev, input, output)
+		}
+		seen[output] = input
+		outputs[i] = output
+	}
+	return outputs, nil
+}
+
+// skipSuffixed drops the files whose name, without extension, already ends
+// in suffix: they are the outputs of an earlier run with -output-suffix.
+func skipSuffixed(files []string, suffix string) []string {
+	kept := files[:0]
+	for _, file := range files {
+		if !strings.HasSuffix(strings.TrimSuffix(file, filepath.Ext(file)), suffix) {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+// doBatch converts every png file below dir into bo.outDir, keeping the
+// relative layout, to the paths built by bo.template, or next to the inputs
+// with bo.suffix. A file that fails is reported and skipped, unless
+// bo.failFast is set, which stops the run. It returns the number of files
+// that failed.
+func doBatch(dir string, bo batchOptions, co convertOptions) (int, error) {
+	if bo.outDir == "" && bo.template == "" && bo.suffix == "" {
+		return 0, errors.New("batch mode needs -outdir, -o-template or -output-suffix")
+	}
+	files, err := findPngFiles(dir, !bo.noSort, bo.maxFiles)
+	if err != nil {
+		return 0, err
+	}
+	if bo.suffix != "" {
+		files = skipSuffixed(files, bo.suffix)
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("%w in %v", errNoInputs, dir)
+	}
+	outputs, err := outputPaths(dir, files, bo, co)
+	if err != nil {
+		return 0, err
+	}
+	_, failed := convertFiles(files, outputs, bo, co, nil)
+	return failed, nil
+}
+
+// convertFiles converts every input to the output at the same index,
+// reporting failures as it goes, and returns the number of files it tried,
+// which is less than all with bo.failFast, and of those that failed. If
+// describe is set, it gets to add context to the errors.
+func convertFiles(files, outputs []string, bo batchOptions, co convertOptions, describe func(i int, err error) error) (int, int) {
+	// Chunk buffers are recycled from one file to the next.
+	co.pool = ipaPng.NewBufferPool()
+	if co.suffixDims {
+		co.written = make(map[string]string, len(files))
+	}
+	tried, failed := 0, 0
+	for i, input := range files {
+		tried++
+		output := outputs[i]
+		err := os.MkdirAll(filepath.Dir(output), 0777)
+		if err == nil {
+			err = doCgbiToPng(input, output, co)
+		}
+		if err != nil {
+			if describe != nil {
+				err = describe(i, err)
+			}
+			reportError(input, err)
+			if rerr := bo.report.add(input, err); rerr != nil {
+				log.Printf("writing the error report failed, no more rows are added: %v", rerr)
+				bo.report = nil
+			}
+			failed++
+			if bo.failFast {
+				break
+			}
+		}
+	}
+	return tried, failed
+}
+
+// readListFile reads the input paths of a -list file, one per line. Blank
+// lines and lines starting with # are skipped. It also returns the line
+// number of every path.
+func readListFile(list string) ([]string, []int, error) {
+	b, err := readInput(list)
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []string
+	var lines []int
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+		lines = append(lines, i+1)
+	}
+	return files, lines, nil
+}
+
+// doList converts the files named in the list file into bo.outDir, by base
+// name, to the paths built by bo.template, or next to them with bo.suffix.
+// Urls are fetched ahead, bo.fetches at a time. Like doBatch it returns the
+// number of files that failed; their errors mention the line of the list.
+func doList(list string, bo batchOptions, co convertOptions) (int, error) {
+	if bo.outDir == "" && bo.template == "" && bo.suffix == "" {
+		return 0, errors.New("list mode needs -outdir, -o-template or -output-suffix")
+	}
+	files, lines, err := readListFile(list)
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("%w in %v", errNoInputs, list)
+	}
+	if bo.maxFiles > 0 && len(files) > bo.maxFiles {
+		return 0, tooManyFiles(bo.maxFiles)
+	}
+	outputs, err := outputPaths("", files, bo, co)
+	if err != nil {
+		return 0, err
+	}
+	read, stop := prefetch(files, bo.fetches)
+	defer stop()
+	co.read = read
+	_, failed := convertFiles(files, outputs, bo, co, func(i int, err error) error {
+		return fmt.Errorf("%v:%d: %w", list, lines[i], err)
+	})
+	return failed, nil
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/poolqa/CgbiPngFix/ipaPng"
+)
+
+// Exit codes of the command line tool.
+const (
+	exitOK      = 0 // everything went fine
+	exitFailure = 1 // an input could not be read, decoded or converted
+	exitUsage   = 2 // the command line is invalid
+	exitNotCgBI = 3 // check: the input is a standard png, not CgBI
+	exitDiffer  = 4 // compare: the images differ beyond the tolerance
+	exitNothing = 6 // batch: no png files were found to convert
+)
+
+// A command is a subcommand of the tool with its own flags.
+type command struct {
+	name    string
+	summary string
+	flags   *flag.FlagSet
+	run     func(fs *flag.FlagSet) int
+}
+
+var commands = []*command{
+	newCommand("convert", "convert a CgBI png to a standard png", runConvert,
+		addCommonFlags, addInputFlags, addConvertFlags, addOutputFlags),
+	newCommand("check", "tell whether a png is CgBI and decodes cleanly", runCheck,
+		addCommonFlags, addInputFlags, addCheckFlags),
+	newCommand("info", "print a json summary of a png", runInfo,
+		addCommonFlags, addInputFlags, addInfoFlags),
+	newCommand("batch", "convert every png below a directory or named in a list", runBatch,
+		addCommonFlags, addBatchFlags, addOutputFlags),
+	newCommand("repair", "rewrite a png with every chunk CRC corrected, changing nothing else", runRepair,
+		addCommonFlags, addInputFlags, addRepairFlags),
+	newCommand("ico", "pack pngs, given as arguments, into a windows icon file", runIco,
+		addCommonFlags, addIcoFlags),
+	newCommand("compare", "compare two pngs, given as arguments, pixel by pixel", runCompare,
+		addCommonFlags, addCompareFlags),
+}
+
+// newCommand builds a command whose flag set holds the given flag groups.
+func newCommand(name, summary string, run func(fs *flag.FlagSet) int, groups ...func(fs *flag.FlagSet)) *command {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	for _, add := range groups {
+		add(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v %v [options]\n\n%v.\n\nOptions:\n", progName(), name, summary)
+		fs.PrintDefaults()
+	}
+	return &command{name: name, summary: summary, flags: fs, run: run}
+}
+
+// findCommand returns the command called name, or nil.
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// The flag groups below are shared by the commands and the flag-only form.
+
+func addCommonFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&Options.JSONErrors, "json-errors", false, "print errors to stderr as json lines with file, stage and error")
+	fs.StringVar(&Options.LogFormat, "log-format", logFormatText, "print logs to stderr as `format`: text, or json with a line per converted file")
+	fs.BoolVar(&Options.Verbose, "v", false, "log what was done to each file, e.g. whether colors were un-premultiplied")
+	fs.BoolVar(&Options.Quiet, "quiet", false, "only print errors and results, no warnings or other logs")
+}
+
+func addInputFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Options.Input, "i", "", "set source ios png `input` file or http(s) url")
+	fs.DurationVar(&Options.Timeout, "timeout", 30*time.Second, "give up fetching an http(s) input after `duration`")
+}
+
+func addCheckFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&Options.Validate, "validate", false, "also verify the IDAT checksum and that the deflate parameters suit standard png decoders")
+}
+
+func addInfoFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&Options.Tree, "tree", false, "print the chunks as a tree instead, with APNG frames grouped")
+}
+
+func addConvertFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Options.Output, "o", "", "set fixed png `output` file")
+	fs.BoolVar(&Options.AvgColor, "avgcolor", false, "print the average color of the input file as #rrggbbaa")
+	fs.BoolVar(&Options.BlurHash, "blurhash", false, "print the BlurHash of the input file, with 4x3 components")
+	fs.BoolVar(&Options.Hash, "hash", false, "print the SHA-256 of the fixed png of the input file, in hex")
+	fs.StringVar(&Options.Mask, "mask", "", "also write the alpha channel of the input as a grayscale png to `file`")
+	fs.IntVar(&Options.MaskThreshold, "mask-threshold", -1, "make -mask black and white, white where the alpha is at least `n`, 0 to 255")
+	fs.StringVar(&Options.Tint, "tint", "", "multiply every pixel by `color`, given as #rrggbb or #rrggbbaa")
+	fs.StringVar(&Options.Flip, "flip", "", "mirror the image: v for top to bottom, h for left to right")
+	fs.IntVar(&Options.Rotate, "rotate", 0, "rotate the image clockwise by `degrees`: 90, 180 or 270, after -flip")
+	fs.BoolVar(&Options.Trim, "trim", false, "crop the transparent padding around the image, after -flip and -rotate")
+	fs.StringVar(&Options.InputBase64, "input-base64", "", "read the input png from base64 `data` instead of -i")
+	fs.BoolVar(&Options.OutputBase64, "output-base64", false, "print the output as base64 to stdout instead of writing -o")
+	fs.IntVar(&Options.Slice, "slice", 0, "split the image into `n` frames of equal height, written as <output>_0 to <output>_<n-1>")
+	fs.BoolVar(&Options.KeepCgBIChunk, "keep-cgbi-chunk", false, "keep the input as it is, CgBI or not, and only correct its chunk CRCs, like repair")
+}
+
+func addBatchFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Options.Dir, "dir", "", "batch mode: convert every png below `directory`")
+	fs.StringVar(&Options.List, "list", "", "batch mode: convert the pngs named in `file`, one path per line")
+	fs.StringVar(&Options.Ipa, "ipa", "", "batch mode: convert the pngs below Payload/ in the .ipa `archive`")
+	fs.StringVar(&Options.OutDir, "outdir", "", "batch mode: write fixed pngs into `directory` (default $CGBIFIX_OUTDIR or the working directory)")
+	fs.StringVar(&Options.OutTemplate, "o-template", "", "batch mode: name outputs after `template`, e.g. {dir}/{name}.fixed.{ext}")
+	fs.StringVar(&Options.OutSuffix, "output-suffix", "", "batch mode: write outputs next to their inputs, with `suffix` added to the name, e.g. .fixed")
+	fs.BoolVar(&Options.NoSort, "no-sort", false, "batch mode: process files in directory order instead of sorted by path")
+	fs.BoolVar(&Options.FailFast, "fail-fast", false, "batch mode: stop at the first file that fails")
+	fs.IntVar(&Options.FetchLimit, "concurrency-limit", 4, "batch mode: fetch up to `n` url inputs of a -list at once")
+	fs.IntVar(&Options.MaxFiles, "max-files", 0, "batch mode: refuse to run on more than `n` files (default no limit)")
+	fs.StringVar(&Options.ErrorReport, "error-report", "", "batch mode: also write the failures to the csv `file`, with file, stage and message")
+}
+
+func addOutputFlags(fs *flag.FlagSet) {
+	addWriteFlags(fs)
+	fs.BoolVar(&Options.Recompress, "recompress", false, "re-encode inputs that are already standard pngs instead of copying them")
+	fs.StringVar(&Options.Format, "f", formatPNG, "write outputs as `format`: png, jpeg, tiff or webp")
+	fs.IntVar(&Options.Quality, "quality", 0, "quality of jpeg or lossy webp outputs, `n` from 1 to 100 (default jpeg 75, webp lossless)")
+	fs.BoolVar(&Options.SuffixDims, "suffix-dims", false, "append the image size to output names, e.g. icon_180x180.png")
+	fs.StringVar(&Options.Comment, "comment", "", "add a tEXt Comment chunk with `text` to png outputs")
+	fs.BoolVar(&Options.Sidecar, "sidecar", false, "also write the metadata of every output as json to <output>.json")
+	fs.BoolVar(&Options.StrictSpec, "strict-spec", false, "re-read png outputs and fail on chunk order, CRC or other PNG spec violations")
+	fs.StringVar(&Options.PaletteFrom, "palette-from", "", "map outputs onto the palette of `file`, a GIMP .gpl palette or a png with PLTE")
+}
+
+// addWriteFlags adds the flags on how output files are written.
+func addWriteFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&Options.NoAtomic, "no-atomic", false, "write output files directly instead of through a temporary file and rename")
+	fs.StringVar(&Options.Mode, "m", "", "set output file `mode` in octal, e.g. 664 (default 666 minus umask)")
+}
+
+func addRepairFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Options.Output, "o", "", "write the repaired png to `output`")
+	addWriteFlags(fs)
+}
+
+func addIcoFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Options.Output, "o", "", "write the icon to `output`, e.g. app.ico")
+	addWriteFlags(fs)
+}
+
+func addCompareFlags(fs *flag.FlagSet) {
+	fs.IntVar(&Options.Tolerance, "tolerance", 0, "accept channels differing by up to `n` out of 255")
+}
+
+// convertOptionsFromFlags builds the convertOptions selected on the command line.
+func convertOptionsFromFlags() (convertOptions, error) {
+	mode, err := parseMode(Options.Mode)
+	if err != nil {
+		return convertOptions{}, err
+	}
+	format, err := parseFormat(Options.Format)
+	if err != nil {
+		return convertOptions{}, err
+	}
+	if Options.Quality < 0 || Options.Quality > 100 || Options.Quality != 0 && format != formatJPEG && format != formatWebP {
+		return convertOptions{}, fmt.Errorf("-quality needs a value from 1 to 100 and -f jpeg or webp")
+	}
+	if Options.Comment != "" && format != formatPNG {
+		return convertOptions{}, fmt.Errorf("-comment needs png output, not %v", format)
+	}
+	if Options.StrictSpec && format != formatPNG {
+		return convertOptions{}, fmt.Errorf("-strict-spec needs png output, not %v", format)
+	}
+	co := convertOptions{
+		mode:       mode,
+		atomic:     !Options.NoAtomic,
+		recompress: Options.Recompress,
+		format:     format,
+		quality:    Options.Quality,
+		suffixDims: Options.SuffixDims,
+		comment:    Options.Comment,
+		sidecar:    Options.Sidecar,
+		strictSpec: Options.StrictSpec,
+	}
+	if Options.PaletteFrom != "" {
+		if co.palette, err = loadPalette(Options.PaletteFrom); err != nil {
+			return convertOptions{}, fmt.Errorf("invalid -palette-from: %v", err)
+		}
+	}
+	return co, nil
+}
+
+// needInput makes sure there is an input, printing the usage of fs
+// otherwise. Positional arguments stand in for -i and, if fs has it, -o.
+func needInput(fs *flag.FlagSet) bool {
+	if err := takeArgs(fs, fs.Lookup("o") != nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		return false
+	}
+	if Options.Input == "" && Options.InputBase64 == "" {
+		fmt.Fprintln(os.Stderr, "missing -i input")
+		fs.Usage()
+		return false
+	}
+	return true
+}
+
+// takeArgs fills -i and, with output set, -o from the positional arguments
+// of fs, in that order. The flags win: an argument only fills a flag that
+// was not given, so "-o out.png in.png" works too.
+func takeArgs(fs *flag.FlagSet, output bool) error {
+	args := fs.Args()
+	if Options.Input == "" && Options.InputBase64 == "" && len(args) > 0 {
+		Options.Input, args = args[0], args[1:]
+	}
+	if output && Options.Output == "" && len(args) > 0 {
+		Options.Output, args = args[0], args[1:]
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", strings.Join(args, " "))
+	}
+	return nil
+}
+
+func runConvert(fs *flag.FlagSet) int {
+	if !needInput(fs) {
+		return exitUsage
+	}
+	co, err := convertOptionsFromFlags()
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if Options.Tint != "" {
+		tint, err := parseColor(Options.Tint)
+		if err != nil {
+			log.Print(err)
+			return exitUsage
+		}
+		co.tint = &tint
+	}
+	if Options.Flip != "" && Options.Flip != "v" && Options.Flip != "h" {
+		log.Printf("invalid -flip %q, expected v or h", Options.Flip)
+		return exitUsage
+	}
+	switch Options.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		log.Printf("invalid -rotate %d, expected 90, 180 or 270", Options.Rotate)
+		return exitUsage
+	}
+	co.flip, co.rotate = Options.Flip, Options.Rotate
+	co.trim = Options.Trim
+	if Options.Slice < 0 {
+		log.Printf("invalid -slice %d, expected a number of frames", Options.Slice)
+		return exitUsage
+	}
+	co.slice = Options.Slice
+	if Options.MaskThreshold != -1 {
+		if Options.MaskThreshold < 0 || Options.MaskThreshold > 255 {
+			log.Printf("invalid -mask-threshold %d, expected 0 to 255", Options.MaskThreshold)
+			return exitUsage
+		}
+		if Options.Mask == "" {
+			log.Print("-mask-threshold needs -mask")
+			return exitUsage
+		}
+	}
+	if Options.KeepCgBIChunk {
+		if err := checkKeepCgBIChunk(co); err != nil {
+			log.Print(err)
+			return exitUsage
+		}
+	}
+	if Options.InputBase64 != "" || Options.OutputBase64 {
+		return runBase64(co)
+	}
+	if Options.Output == "" && !Options.AvgColor && !Options.BlurHash && !Options.Hash && Options.Mask == "" {
+		fmt.Fprintln(os.Stderr, "missing -o output")
+		fs.Usage()
+		return exitUsage
+	}
+	if Options.AvgColor {
+		doAvgColor(Options.Input)
+	}
+	if Options.BlurHash {
+		doBlurHash(Options.Input)
+	}
+	if Options.Hash {
+		doHash(Options.Input)
+	}
+	if Options.Mask != "" {
+		if err = doMask(Options.Input, Options.Mask, Options.MaskThreshold, co); err != nil {
+			reportError(Options.Input, err)
+			return exitFailure
+		}
+	}
+	// The extra outputs above don't need a converted png.
+	if Options.Output == "" && (Options.AvgColor || Options.BlurHash || Options.Hash || Options.Mask != "") {
+		return exitOK
+	}
+	if Options.KeepCgBIChunk {
+		err = doRepair(Options.Input, Options.Output, co)
+	} else {
+		err = doCgbiToPng(Options.Input, Options.Output, co)
+	}
+	if err != nil {
+		reportError(Options.Input, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// checkKeepCgBIChunk rejects the options that change the output, which
+// -keep-cgbi-chunk leaves as it is.
+func checkKeepCgBIChunk(co convertOptions) error {
+	switch {
+	case co.format != formatPNG || co.quality != 0 || co.tint != nil || co.flip != "" || co.rotate != 0 || co.trim ||
+		co.recompress || co.comment != "" || co.suffixDims || co.slice > 0 || co.palette != nil || co.sidecar || co.strictSpec:
+		return fmt.Errorf("-keep-cgbi-chunk cannot be combined with -f, -quality, -tint, -flip, -rotate, -trim, -recompress, -comment, -suffix-dims, -slice, -palette-from, -sidecar or -strict-spec")
+	case Options.InputBase64 != "" || Options.OutputBase64:
+		return fmt.Errorf("-keep-cgbi-chunk cannot be combined with -input-base64 or -output-base64")
+	}
+	return nil
+}
+
+// runBase64 converts with -input-base64 or -output-base64 set.
+func runBase64(co convertOptions) int {
+	switch {
+	case Options.InputBase64 != "" && Options.Input != "":
+		log.Print("-i and -input-base64 cannot be combined")
+		return exitUsage
+	case Options.OutputBase64 && Options.Output != "":
+		log.Print("-o and -output-base64 cannot be combined")
+		return exitUsage
+	case !Options.OutputBase64 && Options.Output == "":
+		log.Print("missing -o output")
+		return exitUsage
+	case Options.AvgColor || Options.BlurHash || Options.Hash || Options.Mask != "" || co.suffixDims || co.slice > 0 || co.sidecar || co.strictSpec:
+		log.Print("-avgcolor, -blurhash, -hash, -mask, -suffix-dims, -slice, -sidecar and -strict-spec need -i and -o")
+		return exitUsage
+	}
+	input := Options.Input
+	if input == "" {
+		input = "base64 input"
+	}
+	if err := doBase64(input, Options.InputBase64, Options.Output, co); err != nil {
+		reportError(input, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func runCheck(fs *flag.FlagSet) int {
+	if !needInput(fs) {
+		return exitUsage
+	}
+	b, err := readInput(Options.Input)
+	if err != nil {
+		reportError(Options.Input, &ipaPng.StageError{Stage: stageRead, Err: err})
+		return exitFailure
+	}
+	var problems []string
+	if Options.Validate {
+		// Decoding fails on most of these without naming the problem, so
+		// look at the chunks first. Files that don't even parse are left
+		// to the decoder to report.
+		if chunks, err := ipaPng.ParseChunks(bytes.NewReader(b)); err == nil {
+			problems = ipaPng.ValidateZlibChunks(chunks)
+		}
+		for _, p := range problems {
+			reportError(Options.Input, &ipaPng.StageError{Stage: ipaPng.StageIDAT, Err: errors.New(p)})
+		}
+	}
+	cgbi, err := ipaPng.DecodeWithOptions(bytes.NewReader(b), ipaPng.DecodeOptions{VerifyChecksum: Options.Validate})
+	if err != nil {
+		reportError(Options.Input, err)
+		return exitFailure
+	}
+	if Options.Validate {
+		reportWarnings(Options.Input, cgbi.Warnings())
+	}
+	if !cgbi.IsCgBI {
+		fmt.Printf("%v: standard png\n", Options.Input)
+	} else {
+		fmt.Printf("%v: CgBI\n", Options.Input)
+	}
+	switch {
+	case len(problems) > 0:
+		return exitFailure
+	case !cgbi.IsCgBI:
+		return exitNotCgBI
+	}
+	return exitOK
+}
+
+func runInfo(fs *flag.FlagSet) int {
+	if !needInput(fs) {
+		return exitUsage
+	}
+	if Options.Tree {
+		doTree(Options.Input)
+	} else {
+		doInfo(Options.Input)
+	}
+	return exitOK
+}
+
+func runBatch(fs *flag.FlagSet) int {
+	if Options.Dir == "" && Options.List == "" && Options.Ipa == "" {
+		fmt.Fprintln(os.Stderr, "missing -dir directory, -list file or -ipa archive")
+		fs.Usage()
+		return exitUsage
+	}
+	co, err := convertOptionsFromFlags()
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if err := checkOutputSuffix(); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if Options.FetchLimit < 1 {
+		log.Print("-concurrency-limit needs at least 1")
+		return exitUsage
+	}
+	if Options.Ipa != "" && Options.OutDir == "" && Options.Output != "" {
+		// As in "-ipa App.ipa -o out/", -o names the output directory.
+		Options.OutDir = Options.Output
+	}
+	bo := batchOptions{
+		outDir:   defaultOutDir(),
+		template: Options.OutTemplate,
+		suffix:   Options.OutSuffix,
+		failFast: Options.FailFast,
+		noSort:   Options.NoSort,
+		maxFiles: Options.MaxFiles,
+		fetches:  Options.FetchLimit,
+	}
+	switch co.format {
+	case formatJPEG:
+		bo.ext = ".jpg"
+	case formatTIFF:
+		bo.ext = ".tiff"
+	case formatWebP:
+		bo.ext = ".webp"
+	}
+	if Options.ErrorReport != "" {
+		if bo.report, err = createErrorReport(Options.ErrorReport); err != nil {
+			log.Print(err)
+			return exitFailure
+		}
+		defer bo.report.Close()
+	}
+	var failed int
+	if Options.Ipa != "" {
+		failed, err = doIpa(Options.Ipa, bo, co)
+	} else if Options.List != "" {
+		failed, err = doList(Options.List, bo, co)
+	} else {
+		failed, err = doBatch(Options.Dir, bo, co)
+	}
+	if errors.Is(err, errNoInputs) {
+		log.Print(err)
+		return exitNothing
+	}
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	if failed > 0 {
+		logInfo("%d file(s) failed", failed)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// checkOutputSuffix rejects an -output-suffix that is combined with another
+// way of naming outputs or that would move them out of their directory.
+func checkOutputSuffix() error {
+	switch {
+	case Options.OutSuffix == "":
+		return nil
+	case Options.OutDir != "" || Options.OutTemplate != "":
+		return fmt.Errorf("-output-suffix cannot be combined with -outdir or -o-template")
+	case Options.Ipa != "":
+		return fmt.Errorf("-output-suffix cannot write next to the entries of an -ipa archive")
+	case strings.ContainsAny(Options.OutSuffix, `/\`):
+		return fmt.Errorf("invalid -output-suffix %q, it must not contain a path separator", Options.OutSuffix)
+	}
+	return nil
+}
+
+// outDirEnv names the environment variable holding the default -outdir.
+const outDirEnv = "CGBIFIX_OUTDIR"
+
+// defaultOutDir returns the output directory of batch mode: -outdir if
+// given, otherwise $CGBIFIX_OUTDIR, otherwise the working directory. With
+// -o-template there is none.
+func defaultOutDir() string {
+	switch {
+	case Options.OutDir != "":
+		return Options.OutDir
+	case Options.OutTemplate != "", Options.OutSuffix != "":
+		return ""
+	case os.Getenv(outDirEnv) != "":
+		return os.Getenv(outDirEnv)
+	}
+	return "."
+}
+
+// runRepair rewrites the input chunk by chunk with correct CRCs. The chunk
+// data is copied as is, so CgBI files stay CgBI.
+func runRepair(fs *flag.FlagSet) int {
+	if !needInput(fs) {
+		return exitUsage
+	}
+	if Options.Output == "" {
+		fmt.Fprintln(os.Stderr, "missing -o output")
+		fs.Usage()
+		return exitUsage
+	}
+	mode, err := parseMode(Options.Mode)
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	co := convertOptions{mode: mode, atomic: !Options.NoAtomic}
+	if err := doRepair(Options.Input, Options.Output, co); err != nil {
+		reportError(Options.Input, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// doRepair writes input to output with every chunk CRC corrected, for
+// repair and -keep-cgbi-chunk. Nothing is written if input can't be parsed.
+func doRepair(input, output string, co convertOptions) error {
+	b, err := readInput(input)
+	if err != nil {
+		return &ipaPng.StageError{Stage: stageRead, Err: err}
+	}
+	var repaired bytes.Buffer
+	fixed, total, err := ipaPng.RepairCRCs(bytes.NewReader(b), &repaired)
+	if err != nil {
+		return err
+	}
+	err = writeFile(output, protectInput(co, input, output), func(w io.Writer) error {
+		_, err := repaired.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return &ipaPng.StageError{Stage: stageWrite, Err: err}
+	}
+	logInfo("%v: corrected %d of %d chunk CRCs", input, fixed, total)
+	return nil
+}
+
+// runIco decodes every argument, CgBI or not, and packs the images into
+// one icon file.
+func runIco(fs *flag.FlagSet) int {
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "ico needs at least one png")
+		fs.Usage()
+		return exitUsage
+	}
+	if Options.Output == "" {
+		fmt.Fprintln(os.Stderr, "missing -o output")
+		fs.Usage()
+		return exitUsage
+	}
+	mode, err := parseMode(Options.Mode)
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	icons := make([]*ipaPng.IpaPNG, fs.NArg())
+	for i, input := range fs.Args() {
+		if icons[i], err = decodeFile(input); err != nil {
+			reportError(input, err)
+			return exitFailure
+		}
+	}
+	co := convertOptions{mode: mode, atomic: !Options.NoAtomic}
+	err = writeFile(Options.Output, co, func(w io.Writer) error {
+		return ipaPng.EncodeICO(w, icons)
+	})
+	for i, input := range fs.Args() {
+		reportWarnings(input, icons[i].Warnings())
+	}
+	if err != nil {
+		reportError(Options.Output, &ipaPng.StageError{Stage: stageWrite, Err: err})
+		return exitFailure
+	}
+	return exitOK
+}
+
+func runCompare(fs *flag.FlagSet) int {
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "compare needs two files")
+		fs.Usage()
+		return exitUsage
+	}
+	a, b := fs.Arg(0), fs.Arg(1)
+	ca, err := decodeFile(a)
+	if err != nil {
+		reportError(a, err)
+		return exitFailure
+	}
+	cb, err := decodeFile(b)
+	if err != nil {
+		reportError(b, err)
+		return exitFailure
+	}
+	d, err := ipaPng.Compare(ca.Img, cb.Img)
+	if err != nil {
+		// Images of different sizes differ by any measure.
+		fmt.Printf("%v and %v: %v\n", a, b, err)
+		return exitDiffer
+	}
+	fmt.Printf("%v and %v: %d of %d pixels differ, max channel delta %d\n", a, b, d.Differ, d.Pixels, d.MaxDelta)
+	if int(d.MaxDelta) > Options.Tolerance {
+		return exitDiffer
+	}
+	return exitOK
+}
@@ -1,3 +1,5 @@
 module github.com/poolqa/CgbiPngFix
 
 go 1.14
+
+require golang.org/x/image v0.0.0-20210220032944-ac19c3e999fb
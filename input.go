@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// isURL reports whether input names an http(s) resource rather than a file.
+func isURL(input string) bool {
+	return strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://")
+}
+
+// readInput returns the content of input, which is a file path or an
+// http(s) url fetched within Options.Timeout.
+func readInput(input string) ([]byte, error) {
+	if !isURL(input) {
+		return ioutil.ReadFile(input)
+	}
+	client := &http.Client{Timeout: Options.Timeout}
+	resp, err := client.Get(input)
+	if err != nil {
+		return nil, fmt.Errorf("network error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("network error: get %v: %v", input, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("network error: read %v: %v", input, err)
+	}
+	return b, nil
+}
+
+// urlFetch is a url input being fetched by prefetch.
+type urlFetch struct {
+	index   int           // position in the fetch queue
+	done    chan struct{} // closed once b and err are set
+	b       []byte
+	err     error
+	started bool // the request was sent, guarded by the mutex of prefetch
+	taken   bool // handed out or passed over by the reader, b is released
+}
+
+// prefetch starts fetching the url inputs among files in the background, in
+// order, so that a list of urls is downloaded while the inputs before are
+// converted. A fetch holds one of limit slots until its body is read, which
+// bounds both the requests in flight and how far fetching runs ahead of the
+// conversion, so neither the server nor memory is hammered. It returns a
+// function for convertOptions.read that waits for the fetch of an input,
+// reading files and repeated urls as readInput does, and one that stops
+// fetching the urls not started yet. Both are meant for a single goroutine,
+// which reads the inputs in the order of files; urls it skips are dropped.
+func prefetch(files []string, limit int) (read func(input string) ([]byte, error), stop func()) {
+	fetches := make(map[string]*urlFetch)
+	var queue []*urlFetch
+	var urls []string
+	for _, input := range files {
+		if isURL(input) && fetches[input] == nil {
+			f := &urlFetch{index: len(queue), done: make(chan struct{})}
+			fetches[input] = f
+			queue = append(queue, f)
+			urls = append(urls, input)
+		}
+	}
+	// A slot in sem is taken for every url fetched or in flight and not read.
+	sem := make(chan struct{}, limit)
+	quit := make(chan struct{})
+	var mu sync.Mutex
+	reached := 0 // the reader is past the queue entries before this one
+	go func() {
+		for i, f := range queue {
+			select {
+			case sem <- struct{}{}:
+			case <-quit:
+				return
+			}
+			mu.Lock()
+			skip := f.taken
+			f.started = !skip
+			mu.Unlock()
+			if skip {
+				<-sem
+				continue
+			}
+			go func(url string, f *urlFetch) {
+				f.b, f.err = readInput(url)
+				close(f.done)
+			}(urls[i], f)
+		}
+	}()
+	read = func(input string) ([]byte, error) {
+		f := fetches[input]
+		if f == nil || f.taken {
+			return readInput(input)
+		}
+		// Free the slots of the urls passed over, once their fetch is done.
+		mu.Lock()
+		for _, g := range queue[reached:f.index] {
+			g.taken = true
+			if g.started {
+				go func(g *urlFetch) {
+					<-g.done
+					g.b = nil
+					<-sem
+				}(g)
+			}
+		}
+		reached = f.index + 1
+		mu.Unlock()
+		<-f.done
+		f.taken = true
+		b := f.b
+		f.b = nil
+		<-sem
+		return b, f.err
+	}
+	return read, func() { close(quit) }
+}
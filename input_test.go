@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrefetchLimit(t *testing.T) {
+	icon, err := ioutil.ReadFile("testdata/icon.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const limit = 2
+	var inFlight, maxInFlight, served int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&served, 1)
+		w.Write(icon)
+	}))
+	defer srv.Close()
+
+	var files []string
+	for i := 0; i < 10; i++ {
+		files = append(files, srv.URL+"/"+strconv.Itoa(i)+".png")
+	}
+	read, stop := prefetch(files, limit)
+	defer stop()
+	for i, f := range files {
+		// Give the fetches time to run ahead of the reader.
+		time.Sleep(20 * time.Millisecond)
+		if n := atomic.LoadInt32(&served); int(n) > i+limit {
+			t.Errorf("before reading #%d: %d urls fetched, want at most %d", i, n, i+limit)
+		}
+		b, err := read(f)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(b, icon) {
+			t.Errorf("#%d: wrong body", i)
+		}
+	}
+	if n := atomic.LoadInt32(&maxInFlight); n > limit {
+		t.Errorf("%d requests in flight, want at most %d", n, limit)
+	}
+}
+
+func TestPrefetchSkip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	var files []string
+	for i := 0; i < 6; i++ {
+		files = append(files, srv.URL+"/"+strconv.Itoa(i))
+	}
+	read, stop := prefetch(files, 1)
+	defer stop()
+	// Skipping urls frees their slots rather than stalling the later ones.
+	for _, i := range []int{0, 3, 5} {
+		done := make(chan struct{})
+		var b []byte
+		var err error
+		go func() {
+			b, err = read(files[i])
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reading #%d after skipping urls hangs", i)
+		}
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if want := "/" + strconv.Itoa(i); string(b) != want {
+			t.Errorf("#%d: body %q, want %q", i, b, want)
+		}
+	}
+	// A skipped url is read directly.
+	if b, err := read(files[1]); err != nil || string(b) != "/1" {
+		t.Errorf("skipped #1: body %q, error %v", b, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ipaPayload is the directory of an .ipa archive that holds the app.
+const ipaPayload = "Payload/"
+
+// doIpa converts the png files below Payload/ in the .ipa (zip) archive
+// into bo.outDir, keeping their paths relative to Payload/, or to the paths
+// built by bo.template. The entries are read straight from the archive.
+// Like doBatch it returns the number of files that failed.
+func doIpa(archive string, bo batchOptions, co convertOptions) (int, error) {
+	if bo.outDir == "" && bo.template == "" {
+		return 0, errors.New("ipa mode needs -outdir or -o-template")
+	}
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+
+	entries := make(map[string]*zip.File)
+	var files []string
+	skipped := 0
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		// Cleaning also keeps names with .. from escaping the output
+		// directory: they no longer start with Payload/.
+		name := path.Clean(f.Name)
+		if !strings.HasPrefix(name, ipaPayload) || !isPngName(name) {
+			skipped++
+			continue
+		}
+		entries[name] = f
+		files = append(files, name)
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("%w in %v", errNoInputs, archive)
+	}
+	if !bo.noSort {
+		sort.Strings(files)
+	}
+	if bo.maxFiles > 0 && len(files) > bo.maxFiles {
+		return 0, tooManyFiles(bo.maxFiles)
+	}
+	outputs, err := outputPaths(ipaPayload, files, bo, co)
+	if err != nil {
+		return 0, err
+	}
+	co.read = func(name string) ([]byte, error) {
+		rc, err := entries[name].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	tried, failed := convertFiles(files, outputs, bo, co, nil)
+	logInfo("%v: %d png(s) converted, %d failed, %d other entries skipped",
+		archive, tried-failed, failed, skipped)
+	return failed, nil
+}
@@ -0,0 +1,119 @@
+package ipaPng
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// blurHashSize is the size of the thumbnail a BlurHash is computed from;
+// the few cosine components it keeps don't need more detail.
+const blurHashSize = 32
+
+// BlurHash returns the BlurHash (https://blurha.sh) of the decoded image
+// with xComponents by yComponents cosine components, each from 1 to 9; 4
+// by 3 is the usual choice. It is computed from a small Thumbnail, with
+// transparent areas flattened onto white as BlurHash has no alpha.
+func (cgbi *IpaPNG) BlurHash(xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", errors.New(fmt.Sprintf("invalid BlurHash components %vx%v, expected 1 to 9 each", xComponents, yComponents))
+	}
+	img := cgbi.Thumbnail(blurHashSize)
+	if img == nil {
+		return "", errors.New("no decoded image to hash")
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	// Linearize the flattened pixels once.
+	linear := make([][3]float64, 0, w*h)
+	for y := 0; y < h; y++ {
+		pix := img.Pix[y*img.Stride : y*img.Stride+w*4]
+		for x := 0; x < len(pix); x += 4 {
+			a := uint32(pix[x+3])
+			var p [3]float64
+			for i := range p {
+				p[i] = srgbToLinear(float64((uint32(pix[x+i])*a+255*(255-a)+127)/255) / 255)
+			}
+			linear = append(linear, p)
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * cy
+					p := linear[y*w+x]
+					for k := range f {
+						f[k] += basis * p[k]
+					}
+				}
+			}
+			for k := range f {
+				f[k] /= float64(w * h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	hash := base83(xComponents-1+(yComponents-1)*9, 1)
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash += base83(quantisedMax, 1)
+	} else {
+		hash += base83(0, 1)
+	}
+	dc := factors[0]
+	hash += base83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		v := 0
+		for _, c := range f {
+			q := math.Floor(signPow(c/maxValue, 0.5)*9 + 9.5)
+			v = v*19 + int(math.Max(0, math.Min(18, q)))
+		}
+		hash += base83(v, 2)
+	}
+	return hash, nil
+}
+
+// linearToSRGB converts a linear sample to an 8-bit sRGB one, the inverse
+// of srgbToLinear.
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises the magnitude of v to exp, keeping its sign.
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+const base83Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// base83 encodes v as length base 83 digits, most significant first.
+func base83(v, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Digits[v%83]
+		v /= 83
+	}
+	return string(b)
+}
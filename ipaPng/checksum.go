@@ -0,0 +1,197 @@
+package ipaPng
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+)
+
+// A ChecksumError is returned by Decode with DecodeOptions.VerifyChecksum,
+// and by ZlibToDeflate, when the inflated IDAT data doesn't match the
+// Adler-32 checksum stored after the deflate stream, or when that stream is
+// broken.
+type ChecksumError struct {
+	Stored, Computed uint32 // both 0 when the deflate stream itself is broken
+	Err              error  // the inflater's error for a broken stream
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("corrupt IDAT data: deflate stream is broken: %v", e.Err)
+	}
+	return fmt.Sprintf("corrupt IDAT data: Adler-32 checksum is %08x, but the data gives %08x", e.Stored, e.Computed)
+}
+
+func (e *ChecksumError) Unwrap() error { return e.Err }
+
+// verifyChecksum inflates the whole IDAT stream and checks it against the
+// Adler-32 checksum that follows it. CgBI files often end the stream
+// without one; then there is nothing to compare and only a warning is
+// recorded.
+func (cgbi *IpaPNG) verifyChecksum() error {
+	// Skip the zlib header seeded by the reader.
+	raw := cgbi.IDAT[len(zlibHeader):]
+	n, computed, err := inflateAdler(raw)
+	if err != nil {
+		return &ChecksumError{Err: err}
+	}
+	if len(raw)-n < 4 {
+		cgbi.warn("IDAT has no Adler-32 checksum to verify")
+		return nil
+	}
+	if stored := binary.BigEndian.Uint32(raw[n:]); stored != computed {
+		return &ChecksumError{Stored: stored, Computed: computed}
+	}
+	return nil
+}
+
+// zlibHeader is the zlib header for deflate with a 32K window and the
+// default level, what compress/zlib writes and the reader puts in front of
+// CgBI IDAT data.
+var zlibHeader = []byte{0x78, 0x9c}
+
+// DeflateToZlib wraps the raw deflate stream of CgBI IDAT data into the zlib
+// stream a standard PNG needs: the zlib header goes in front and the
+// Adler-32 checksum of the inflated data after the stream, which is
+// inflated for it. A broken stream is an error; bytes after its end, such
+// as a checksum already present, are dropped.
+func DeflateToZlib(raw []byte) ([]byte, error) {
+	n, sum, err := inflateAdler(raw)
+	if err != nil {
+		return nil, err
+	}
+	z := make([]byte, 0, len(zlibHeader)+n+4)
+	z = append(z, zlibHeader...)
+	z = append(z, raw[:n]...)
+	var trailer [4]byte
+	binary.BigEndian.PutUint32(trailer[:], sum)
+	return append(z, trailer[:]...), nil
+}
+
+// ZlibToDeflate is the inverse of DeflateToZlib: it checks the zlib header
+// and the Adler-32 checksum of z and returns the raw deflate stream between
+// them, as CgBI IDAT data holds it. A stream with a preset dictionary can't
+// be used without it and is rejected; a broken stream or checksum gives a
+// *ChecksumError.
+func ZlibToDeflate(z []byte) ([]byte, error) {
+	if len(z) < 2 {
+		return nil, errors.New("zlib stream is too short for a header")
+	}
+	if problems := ParseZlibHeader(z[0], z[1]).problems(); len(problems) > 0 {
+		return nil, errors.New(fmt.Sprintf("invalid zlib header %02x%02x: %v", z[0], z[1], problems[0]))
+	}
+	raw := z[2:]
+	n, computed, err := inflateAdler(raw)
+	if err != nil {
+		return nil, &ChecksumError{Err: err}
+	}
+	if len(raw)-n < 4 {
+		return nil, errors.New("zlib stream has no Adler-32 checksum")
+	}
+	if stored := binary.BigEndian.Uint32(raw[n:]); stored != computed {
+		return nil, &ChecksumError{Stored: stored, Computed: computed}
+	}
+	return raw[:n:n], nil
+}
+
+// inflateAdler inflates the deflate stream at the start of raw and returns
+// its compressed length and the Adler-32 checksum of the inflated data. A
+// bytes.Reader is an io.ByteReader, so the inflater reads no further than
+// the stream ends.
+func inflateAdler(raw []byte) (int, uint32, error) {
+	b := bytes.NewReader(raw)
+	fr := flate.NewReader(b)
+	defer fr.Close()
+	h := adler32.New()
+	if _, err := io.Copy(h, fr); err != nil {
+		return 0, 0, err
+	}
+	return len(raw) - b.Len(), h.Sum32(), nil
+}
+
+// A ZlibHeader holds the fields of the two byte header of a zlib stream.
+type ZlibHeader struct {
+	Method     int  // CM: 8 is deflate, the only method PNG allows
+	WindowSize int  // from CINFO; PNG decoders need it to be at most 32K
+	Level      int  // FLEVEL: 0 for the fastest to 3 for the best compression, a hint only
+	Dict       bool // FDICT: a preset dictionary is needed, which PNG forbids
+	Check      bool // FCHECK makes the header a multiple of 31, as it must
+}
+
+// ParseZlibHeader splits the zlib header bytes CMF and FLG into their
+// fields.
+func ParseZlibHeader(cmf, flg byte) ZlibHeader {
+	return ZlibHeader{
+		Method:     int(cmf & 0x0f),
+		WindowSize: 1 << (uint(cmf>>4) + 8),
+		Level:      int(flg >> 6),
+		Dict:       flg&0x20 != 0,
+		Check:      (uint(cmf)<<8|uint(flg))%31 == 0,
+	}
+}
+
+// problems lists what keeps h from starting the IDAT stream of a PNG.
+func (h ZlibHeader) problems() []string {
+	var problems []string
+	if !h.Check {
+		problems = append(problems, "the header check bits are wrong")
+	}
+	if h.Method != 8 {
+		problems = append(problems, fmt.Sprintf("compression method %d is not deflate", h.Method))
+	}
+	if h.WindowSize > 32<<10 {
+		problems = append(problems, fmt.Sprintf("window size %d is larger than 32K", h.WindowSize))
+	}
+	if h.Dict {
+		problems = append(problems, "a preset dictionary is needed")
+	}
+	return problems
+}
+
+// ValidateZlib is ValidateZlibChunks for the chunks of the decoded file.
+// Decoding already fails on most of the problems without naming them, so
+// to explain a failure run ValidateZlibChunks over ParseChunks first.
+func (cgbi *IpaPNG) ValidateZlib() []string {
+	return ValidateZlibChunks(cgbi.chunks)
+}
+
+// ValidateZlibChunks checks the deflate parameters of the IDAT stream in
+// chunks, as from ParseChunks, and returns the problems found, none when
+// standard PNG decoders can read it. For a standard PNG the zlib header of
+// IDAT is checked: deflate compression, a window of at most 32K, valid
+// check bits and no preset dictionary. The level is only a hint and any
+// value is fine. CgBI files store raw deflate, whose back references never
+// reach further than 32K, without a header; for them it is checked that the
+// data doesn't start with a zlib header after all, which the decoder would
+// misread. IDAT chunks read with SkipIDAT leave nothing to check.
+func ValidateZlibChunks(chunks []*Chunk) []string {
+	var head []byte
+	for _, c := range chunks {
+		if c.CType != dsSeenIDAT || len(head) >= 2 {
+			continue
+		}
+		if c.Data == nil && c.Length > 0 {
+			return nil
+		}
+		head = append(head, c.Data...)
+	}
+	if len(head) < 2 {
+		return []string{"IDAT is too short for a zlib header"}
+	}
+	h := ParseZlibHeader(head[0], head[1])
+	if len(chunks) > 0 && chunks[0].CType == dsSeenCgBI {
+		if len(h.problems()) == 0 {
+			return []string{fmt.Sprintf("IDAT starts with the zlib header %02x%02x, but CgBI stores raw deflate", head[0], head[1])}
+		}
+		return nil
+	}
+	var problems []string
+	for _, p := range h.problems() {
+		problems = append(problems, fmt.Sprintf("zlib header %02x%02x of IDAT: %v", head[0], head[1], p))
+	}
+	return problems
+}
@@ -0,0 +1,51 @@
+package ipaPng
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDeflateZlibRoundTrip(t *testing.T) {
+	data := cgbiRows(testImage(7, 5), false)
+	raw := compress(data, true)
+
+	z, err := DeflateToZlib(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The result is a zlib stream any reader takes.
+	zr, err := zlib.NewReader(bytes.NewReader(z))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("inflated %d bytes, %v", len(got), err)
+	}
+	back, err := ZlibToDeflate(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back, raw) {
+		t.Error("ZlibToDeflate(DeflateToZlib(raw)) differs from raw")
+	}
+
+	// And the other way around, from a zlib stream of the standard library,
+	// whose header may name another compression level.
+	z = compress(data, false)
+	if raw, err = ZlibToDeflate(z); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := DeflateToZlib(raw); err != nil || !bytes.Equal(again[2:], z[2:]) {
+		t.Errorf("DeflateToZlib(ZlibToDeflate(z)) differs from z: %v", err)
+	}
+
+	// A wrong checksum is caught.
+	z[len(z)-1]++
+	var ce *ChecksumError
+	if _, err := ZlibToDeflate(z); !errors.As(err, &ce) {
+		t.Errorf("got %v, want a ChecksumError", err)
+	}
+}
@@ -4,22 +4,40 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"hash"
+	"hash/crc32"
 	"io"
 )
 
+// ChunkPosition tells where a chunk was found relative to the IDAT run.
+type ChunkPosition int
+
+const (
+	PositionBeforeIDAT ChunkPosition = iota
+	PositionIDAT
+	PositionAfterIDAT
+)
+
 // Each chunk starts with a uint32 length (big endian), then 4 byte name,
 // then data and finally the CRC32 of the chunk data.
 type Chunk struct {
-	Length uint32 // chunk data length
-	CType  string // chunk type
-	Data   []byte // chunk data
-	Crc32  uint32 // CRC32 of chunk data
-	crc    hash.Hash32
+	Length   uint32        // chunk data length
+	CType    string        // chunk type
+	Data     []byte        // chunk data
+	Crc32    uint32        // CRC32 of chunk data
+	Position ChunkPosition // position relative to IDAT, set by Decode
 }
 
 // Populate will read bytes from the reader and populate a chunk.
 func (c *Chunk) Populate(r io.Reader) error {
+	return c.populate(r, nil, nil, nil, false)
+}
+
+// populate is Populate taking the chunk data buffer from bp, if not nil.
+// If rewrite is set, it gets the chunk before the CRC check, which then
+// applies to the rewritten chunk. If skipIDAT is set, it is r, and the data
+// of an IDAT chunk is seeked past instead of read; its CRC is not checked.
+// With ignoreCRC, no CRC is checked at all.
+func (c *Chunk) populate(r io.Reader, bp *BufferPool, rewrite func(*Chunk), skipIDAT io.Seeker, ignoreCRC bool) error {
 
 	// 4 byte
 	buf := make([]byte, 4)
@@ -34,25 +52,76 @@ func (c *Chunk) Populate(r io.Reader) error {
 		return err
 	}
 	c.CType = string(buf)
-	c.crc.Reset()
-	c.crc.Write(buf)
+
+	if skipIDAT != nil && c.CType == dsSeenIDAT {
+		// Skip the data and the CRC.
+		_, err := skipIDAT.Seek(int64(c.Length)+4, io.SeekCurrent)
+		return err
+	}
 
 	// Read chunk data.
-	tmp := make([]byte, c.Length)
+	var tmp []byte
+	if bp != nil {
+		tmp = bp.get(int(c.Length))
+	} else {
+		tmp = make([]byte, c.Length)
+	}
 	if _, err := io.ReadFull(r, tmp); err != nil {
 		return err
 	}
 	c.Data = tmp
-	c.crc.Write(c.Data)
 	// Read CRC32 hash
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
 	c.Crc32 = binary.BigEndian.Uint32(buf)
-	sum32 := c.crc.Sum32()
-	if c.Crc32 != sum32 {
-		fmt.Printf("Crc32:%v, sum crc32:%v\n", c.Crc32, sum32)
-		return errors.New(fmt.Sprintf("invalid checksum CType:%v", c.CType))
+	if rewrite != nil {
+		rewrite(c)
+		c.Length = uint32(len(c.Data))
+	}
+	sum32 := ChunkCRC(c.CType, c.Data)
+	if c.Crc32 != sum32 && !ignoreCRC {
+		return errors.New(fmt.Sprintf("invalid checksum CType:%v, stored %08x, computed %08x", c.CType, c.Crc32, sum32))
 	}
 	return nil
 }
+
+// ChunkCRC returns the CRC32 stored with a chunk of type cType holding data,
+// which covers the type and the data but not the length.
+func ChunkCRC(cType string, data []byte) uint32 {
+	crc := crc32.ChecksumIEEE([]byte(cType))
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
+
+// WriteTo writes the chunk to w: length, type, data and a CRC32 computed
+// from type and data, so edits to Data are reflected. It implements
+// io.WriterTo.
+func (c *Chunk) WriteTo(w io.Writer) (int64, error) {
+	return c.writeTo(w, ChunkCRC(c.CType, c.Data))
+}
+
+// WriteToPreservingCRC writes the chunk like WriteTo, but with the stored
+// Crc32 verbatim instead of a recomputed one. A chunk that was corrupted
+// upstream therefore stays detectably corrupt when it is passed through.
+func (c *Chunk) WriteToPreservingCRC(w io.Writer) (int64, error) {
+	return c.writeTo(w, c.Crc32)
+}
+
+func (c *Chunk) writeTo(w io.Writer, crc uint32) (int64, error) {
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(c.Data)))
+	copy(buf[4:], c.CType)
+	n, err := w.Write(buf[:])
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	n, err = w.Write(c.Data)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	binary.BigEndian.PutUint32(buf[:4], crc)
+	n, err = w.Write(buf[:4])
+	return written + int64(n), err
+}
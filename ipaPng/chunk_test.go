@@ -0,0 +1,93 @@
+package ipaPng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestWriteToPreservingCRC(t *testing.T) {
+	c := &Chunk{Length: 5, CType: "tEXt", Data: []byte("a\x00bcd"), Crc32: 0xdeadbeef}
+	var b bytes.Buffer
+	if _, err := c.WriteToPreservingCRC(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.BigEndian.Uint32(b.Bytes()[b.Len()-4:]); got != 0xdeadbeef {
+		t.Errorf("CRC %08x, want the stored deadbeef", got)
+	}
+	var back Chunk
+	if err := back.Populate(bytes.NewReader(b.Bytes())); err == nil || !strings.Contains(err.Error(), "invalid checksum") {
+		t.Errorf("got %v, want a checksum error", err)
+	}
+
+	// WriteTo recomputes it.
+	b.Reset()
+	if _, err := c.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := back.Populate(bytes.NewReader(b.Bytes())); err != nil {
+		t.Error(err)
+	}
+	if back.Crc32 != ChunkCRC("tEXt", c.Data) {
+		t.Errorf("CRC %08x after WriteTo", back.Crc32)
+	}
+}
+
+func TestWriteChunksRoundTrip(t *testing.T) {
+	f := makeCgBI(testImage(4, 3), false, testChunk{"tEXt", []byte("Title\x00icon")}, testChunk{"pHYs", physData(2835, 2835, 1)})
+	chunks, err := ParseChunks(bytes.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := WriteChunks(&b, chunks); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), f) {
+		t.Error("WriteChunks changed the file")
+	}
+	again, err := ParseChunks(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(chunks) {
+		t.Fatalf("%d chunks, want %d", len(again), len(chunks))
+	}
+	for i, c := range again {
+		if c.CType != chunks[i].CType || !bytes.Equal(c.Data, chunks[i].Data) || c.Crc32 != chunks[i].Crc32 {
+			t.Errorf("chunk #%d: %v, want %v", i, c.CType, chunks[i].CType)
+		}
+	}
+}
+
+func TestChunkRewriter(t *testing.T) {
+	f := makeCgBI(testImage(2, 2), false, testChunk{"tEXt", []byte("Title\x00icon")})
+	// Corrupt the text, keeping its CRC.
+	i := bytes.Index(f, []byte("icon"))
+	f[i] = 'I'
+	if _, err := Decode(bytes.NewReader(f)); err == nil || !strings.Contains(err.Error(), "invalid checksum CType:tEXt") {
+		t.Fatalf("got %v, want a tEXt checksum error", err)
+	}
+	repair := func(c *Chunk) {
+		if c.CType == "tEXt" {
+			c.Data = []byte("Title\x00fixed")
+			c.Crc32 = ChunkCRC(c.CType, c.Data)
+		}
+	}
+
+	// After the CRC check the rewriter comes too late.
+	if _, err := DecodeWithOptions(bytes.NewReader(f), DecodeOptions{ChunkRewriter: repair}); err == nil {
+		t.Error("corrupt chunk passed the CRC check")
+	}
+
+	// Before it, the check applies to the repaired chunk.
+	cgbi := decodeBytes(t, f, DecodeOptions{ChunkRewriter: repair, RewriteBeforeCRC: true})
+	c := cgbi.findChunk("tEXt")
+	if c == nil || string(c.Data) != "Title\x00fixed" || c.Length != uint32(len(c.Data)) {
+		t.Errorf("tEXt chunk %+v", c)
+	}
+	if c != nil && c.Position != PositionBeforeIDAT {
+		t.Errorf("position %v", c.Position)
+	}
+}
@@ -0,0 +1,133 @@
+package ipaPng
+
+import (
+	"image"
+	"image/color"
+)
+
+// AverageColor returns the average color of the decoded image. Color
+// channels are weighted by alpha, so transparent regions don't skew the
+// result; the returned alpha is the plain average alpha.
+func (cgbi *IpaPNG) AverageColor() color.NRGBA {
+	if cgbi.Img == nil {
+		return color.NRGBA{}
+	}
+	nRgba := toNRGBA(cgbi.Img)
+	var r, g, b, a uint64
+	w, h := nRgba.Rect.Dx(), nRgba.Rect.Dy()
+	for y := 0; y < h; y++ {
+		pix := nRgba.Pix[y*nRgba.Stride : y*nRgba.Stride+w*4]
+		for x := 0; x < len(pix); x += 4 {
+			pa := uint64(pix[x+3])
+			r += uint64(pix[x+0]) * pa
+			g += uint64(pix[x+1]) * pa
+			b += uint64(pix[x+2]) * pa
+			a += pa
+		}
+	}
+	if a == 0 {
+		return color.NRGBA{}
+	}
+	n := uint64(w * h)
+	return color.NRGBA{
+		R: uint8((r + a/2) / a),
+		G: uint8((g + a/2) / a),
+		B: uint8((b + a/2) / a),
+		A: uint8((a + n/2) / n),
+	}
+}
+
+// DominantColor returns the most common color of the decoded image, using a
+// histogram of colors reduced to 4 bits per channel. Pixels count with
+// their alpha as weight. The result is the opaque alpha-weighted average of
+// the winning bucket, or the zero color for a fully transparent image.
+func (cgbi *IpaPNG) DominantColor() color.NRGBA {
+	if cgbi.Img == nil {
+		return color.NRGBA{}
+	}
+	type bucket struct {
+		r, g, b, a uint64
+	}
+	var hist [1 << 12]bucket
+	nRgba := toNRGBA(cgbi.Img)
+	w, h := nRgba.Rect.Dx(), nRgba.Rect.Dy()
+	for y := 0; y < h; y++ {
+		pix := nRgba.Pix[y*nRgba.Stride : y*nRgba.Stride+w*4]
+		for x := 0; x < len(pix); x += 4 {
+			pa := uint64(pix[x+3])
+			if pa == 0 {
+				continue
+			}
+			k := int(pix[x+0]>>4)<<8 | int(pix[x+1]>>4)<<4 | int(pix[x+2]>>4)
+			hist[k].r += uint64(pix[x+0]) * pa
+			hist[k].g += uint64(pix[x+1]) * pa
+			hist[k].b += uint64(pix[x+2]) * pa
+			hist[k].a += pa
+		}
+	}
+	best := 0
+	for k := range hist {
+		if hist[k].a > hist[best].a {
+			best = k
+		}
+	}
+	bk := hist[best]
+	if bk.a == 0 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{
+		R: uint8((bk.r + bk.a/2) / bk.a),
+		G: uint8((bk.g + bk.a/2) / bk.a),
+		B: uint8((bk.b + bk.a/2) / bk.a),
+		A: 0xff,
+	}
+}
+
+// Tint returns a copy of the decoded image with every pixel multiplied by c,
+// channel by channel and rounded to nearest. Alpha is multiplied by c.A, so
+// an opaque tint keeps the alpha shape as is.
+func (cgbi *IpaPNG) Tint(c color.NRGBA) *image.NRGBA {
+	if cgbi.Img == nil {
+		return nil
+	}
+	src := toNRGBA(cgbi.Img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	mul := [4]uint32{uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)}
+	for y := 0; y < h; y++ {
+		sp := src.Pix[y*src.Stride : y*src.Stride+w*4]
+		dp := dst.Pix[y*dst.Stride : y*dst.Stride+w*4]
+		for i := range sp {
+			dp[i] = uint8((uint32(sp[i])*mul[i%4] + 127) / 255)
+		}
+	}
+	return dst
+}
+
+// Quantize returns the decoded image mapped onto pal: every pixel becomes
+// the entry nearest to it, by the distance color.Palette.Index uses, with
+// no dithering. Written with image/png the result is a compact paletted
+// PNG. pal must hold 1 to 256 colors; otherwise, or without a decoded
+// image, Quantize returns nil.
+func (cgbi *IpaPNG) Quantize(pal color.Palette) *image.Paletted {
+	if cgbi.Img == nil || len(pal) == 0 || len(pal) > 256 {
+		return nil
+	}
+	b := cgbi.Img.Bounds()
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), pal)
+	// Icons use few distinct colors, so each is matched only once.
+	nearest := make(map[color.NRGBA64]uint8)
+	for y := 0; y < b.Dy(); y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+b.Dx()]
+		for x := range row {
+			c := color.NRGBA64Model.Convert(cgbi.Img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+			i, ok := nearest[c]
+			if !ok {
+				i = uint8(pal.Index(c))
+				nearest[c] = i
+			}
+			row[x] = i
+		}
+	}
+	return dst
+}
@@ -0,0 +1,38 @@
+package ipaPng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestQuantize(t *testing.T) {
+	pal := color.Palette{
+		color.NRGBA{0, 0, 0, 0xff},
+		color.NRGBA{0xff, 0xff, 0xff, 0xff},
+		color.NRGBA{0xff, 0, 0, 0xff},
+		color.NRGBA{0, 0, 0, 0},
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 5, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0x10, 0x08, 0x00, 0xff})
+	img.SetNRGBA(1, 0, color.NRGBA{0xf0, 0xf8, 0xe0, 0xff})
+	img.SetNRGBA(2, 0, color.NRGBA{0xd0, 0x20, 0x10, 0xff})
+	img.SetNRGBA(3, 0, color.NRGBA{0x80, 0x80, 0x80, 0x08})
+	img.SetNRGBA(4, 0, color.NRGBA{0xff, 0x00, 0x00, 0xff})
+	cgbi := FromImage(img)
+	q := cgbi.Quantize(pal)
+	if want := []uint8{0, 1, 2, 3, 2}; !bytes.Equal(q.Pix, want) {
+		t.Errorf("indices %v, want %v", q.Pix, want)
+	}
+	if len(q.Palette) != len(pal) {
+		t.Errorf("palette of %d colors, want %d", len(q.Palette), len(pal))
+	}
+
+	if cgbi.Quantize(nil) != nil {
+		t.Error("empty palette accepted")
+	}
+	if cgbi.Quantize(make(color.Palette, 257)) != nil {
+		t.Error("palette of 257 colors accepted")
+	}
+}
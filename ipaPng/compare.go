@@ -0,0 +1,50 @@
+package ipaPng
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// A Diff summarizes how two images of the same size differ.
+type Diff struct {
+	Pixels   int   // total number of pixels
+	Differ   int   // pixels with at least one differing channel
+	MaxDelta uint8 // largest difference of a single 8-bit channel
+}
+
+// Compare compares a and b pixel by pixel on straight alpha 8-bit RGBA, so
+// a CgBI decode can be checked against a standard PNG of the same image.
+// Images of different sizes are not compared and give an error.
+func Compare(a, b image.Image) (Diff, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return Diff{}, errors.New(fmt.Sprintf("image sizes differ: %vx%v and %vx%v", ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy()))
+	}
+	na, nb := toNRGBA(a), toNRGBA(b)
+	w, h := ab.Dx(), ab.Dy()
+	d := Diff{Pixels: w * h}
+	for y := 0; y < h; y++ {
+		pa := na.Pix[y*na.Stride : y*na.Stride+w*4]
+		pb := nb.Pix[y*nb.Stride : y*nb.Stride+w*4]
+		for x := 0; x < len(pa); x += 4 {
+			differ := false
+			for k := x; k < x+4; k++ {
+				delta := pa[k] - pb[k]
+				if pb[k] > pa[k] {
+					delta = pb[k] - pa[k]
+				}
+				if delta > 0 {
+					differ = true
+				}
+				if delta > d.MaxDelta {
+					d.MaxDelta = delta
+				}
+			}
+			if differ {
+				d.Differ++
+			}
+		}
+	}
+	return d, nil
+}
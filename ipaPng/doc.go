@@ -0,0 +1,10 @@
+// Package ipaPng decodes the Apple CgBI PNG variant found in iOS app
+// bundles (.ipa files) and writes it back out as a standard PNG. Standard
+// PNG files are accepted too and decoded with image/png.
+//
+// IsCgBI tells whether the input was CgBI, and Img holds the decoded image
+// with straight alpha. DecodeWithOptions and EncodeWithOptions tune the
+// steps; ParseChunks and WriteChunks work on the chunks without decoding.
+// Callers that only want the pixels can use DecodeImage, which returns an
+// image.Image. The package example converts a file.
+package ipaPng
@@ -0,0 +1,110 @@
+package ipaPng
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// A ChunkEditor writes a PNG chunk by chunk while the chunks of another one
+// are walked, e.g. by EditChunks or over the result of ParseChunks. Every
+// input chunk is passed on with Copy, left out with Drop or swapped for
+// another one with Replace; calling Copy or Replace more than once inserts
+// chunks. The PNG signature is written before the first chunk.
+//
+// The first write error is kept: later calls do nothing and Close returns
+// it, so the methods need no error checks of their own.
+type ChunkEditor struct {
+	w       *bufio.Writer
+	started bool
+	sawIEND bool
+	err     error
+
+	Copied, Dropped, Replaced int // chunks handled so far
+}
+
+// NewChunkEditor returns a ChunkEditor writing to w. Close must be called
+// once the last chunk was handled.
+func NewChunkEditor(w io.Writer) *ChunkEditor {
+	return &ChunkEditor{w: bufio.NewWriter(w)}
+}
+
+// Copy writes c unchanged, with its stored Crc32, so a chunk that arrived
+// corrupt stays detectably corrupt. Use Replace for chunks whose Data was
+// changed.
+func (e *ChunkEditor) Copy(c *Chunk) {
+	if e.write(c, c.Crc32) {
+		e.Copied++
+	}
+}
+
+// Drop leaves the current input chunk out of the output.
+func (e *ChunkEditor) Drop() {
+	e.Dropped++
+}
+
+// Replace writes c in place of the current input chunk, with a CRC
+// computed from its type and data.
+func (e *ChunkEditor) Replace(c *Chunk) {
+	if e.write(c, ChunkCRC(c.CType, c.Data)) {
+		e.Replaced++
+	}
+}
+
+// write writes c with crc and reports whether that worked.
+func (e *ChunkEditor) write(c *Chunk, crc uint32) bool {
+	if e.err != nil {
+		return false
+	}
+	if !e.started {
+		e.started = true
+		if _, e.err = io.WriteString(e.w, pngHeader); e.err != nil {
+			return false
+		}
+	}
+	if _, e.err = c.writeTo(e.w, crc); e.err != nil {
+		return false
+	}
+	if c.CType == dsSeenIEND {
+		e.sawIEND = true
+	}
+	return true
+}
+
+// Close flushes the output and returns the first error met, including a
+// missing IEND chunk, which would leave the output truncated.
+func (e *ChunkEditor) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.err = e.w.Flush(); e.err != nil {
+		return e.err
+	}
+	if !e.sawIEND {
+		e.err = errors.New("no IEND chunk was written")
+	}
+	return e.err
+}
+
+// EditChunks streams the chunks of the PNG in r through edit, one at a
+// time, with a ChunkEditor writing to w, and closes the editor at the end.
+// Only one chunk is held in memory at a time, so c and its Data are only
+// valid during the call to edit. The chunk level options of opts apply,
+// except SkipIDAT, which would leave nothing to copy.
+func EditChunks(r io.Reader, w io.Writer, opts DecodeOptions, edit func(e *ChunkEditor, c *Chunk)) error {
+	if opts.SkipIDAT {
+		return errors.New("SkipIDAT can't be used when editing chunks")
+	}
+	e := NewChunkEditor(w)
+	err := forEachChunk(r, opts, func(c *Chunk) error {
+		edit(e, c)
+		if opts.BufferPool != nil {
+			opts.BufferPool.put(c.Data)
+		}
+		return e.err
+	})
+	if err != nil {
+		return err
+	}
+	return e.Close()
+}
@@ -0,0 +1,80 @@
+package ipaPng
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrEmptyInput is returned, in a StageError, when the input holds no bytes
+// at all, as opposed to a truncated or foreign one.
+var ErrEmptyInput = errors.New("empty input")
+
+// Decoding stages reported by StageError.
+const (
+	StageSignature = "signature" // reading the PNG signature
+	StageChunk     = "chunk"     // reading chunks and checking their order
+	StageIHDR      = "ihdr"      // parsing the IHDR header
+	StageIDAT      = "idat"      // inflating and unfiltering the pixel data
+	StagePNG       = "png"       // decoding a standard PNG with image/png
+)
+
+// A StageError is returned by Decode when a file is rejected. It tells
+// which step of decoding failed and wraps the underlying error.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string { return e.Err.Error() }
+
+func (e *StageError) Unwrap() error { return e.Err }
+
+// stageError wraps err with stage, leaving nil and already staged errors alone.
+func stageError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*StageError); ok {
+		return err
+	}
+	return &StageError{Stage: stage, Err: err}
+}
+
+// A ChunkOrderError reports a chunk of a CgBI file that is not where the
+// PNG spec allows it, e.g. "IDAT before IHDR" or "duplicate IHDR".
+type ChunkOrderError struct {
+	Chunk    string // type of the misplaced chunk
+	Relation string // "before" or "after" Other
+	Other    string // the chunk whose position rules Chunk out; Chunk itself for duplicates
+	Index    int    // position of the misplaced chunk in the file, counting from 0
+}
+
+func (e *ChunkOrderError) Error() string {
+	if e.Chunk == e.Other {
+		return fmt.Sprintf("chunk out of order: duplicate %v (chunk #%d)", e.Chunk, e.Index)
+	}
+	return fmt.Sprintf("chunk out of order: %v %v %v (chunk #%d)", e.Chunk, e.Relation, e.Other, e.Index)
+}
+
+// A DimensionError reports that the inflated IDAT data is too short for the
+// width and height declared in IHDR, usually because the header is wrong.
+// With DecodeOptions.StrictRowCount it also reports data that is too long.
+type DimensionError struct {
+	Width, Height  int // as declared in IHDR
+	Expected       int // inflated bytes the declared size needs
+	Available      int // inflated bytes IDAT actually holds
+	InferredHeight int // complete rows of the declared width in the data, 0 for interlaced images
+}
+
+func (e *DimensionError) Error() string {
+	problem := "not enough pixel data"
+	if e.Available > e.Expected {
+		problem = "too much pixel data"
+	}
+	msg := fmt.Sprintf("%v: IHDR declares %dx%d, which needs %d bytes, but IDAT holds %d",
+		problem, e.Width, e.Height, e.Expected, e.Available)
+	if e.InferredHeight > 0 {
+		msg += fmt.Sprintf(", enough for a height of %d", e.InferredHeight)
+	}
+	return msg
+}
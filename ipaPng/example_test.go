@@ -0,0 +1,61 @@
+package ipaPng_test
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+
+	"github.com/poolqa/CgbiPngFix/ipaPng"
+)
+
+func ExampleDecode() {
+	f, err := os.Open("testdata/icon.png")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	cgbi, err := ipaPng.Decode(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("CgBI:", cgbi.IsCgBI)
+	fmt.Println("size:", cgbi.Img.Bounds().Size())
+	// Img holds straight alpha, the premultiplication is undone.
+	fmt.Println("opaque:", cgbi.Img.At(8, 8))
+	fmt.Println("half transparent:", cgbi.Img.At(8, 2))
+	// Output:
+	// CgBI: true
+	// size: (16,16)
+	// opaque: {128 128 200 255}
+	// half transparent: {128 32 199 128}
+}
+
+// Converting a file takes a Decode and an Encode.
+func Example_convert() {
+	f, err := os.Open("testdata/icon.png")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	cgbi, err := ipaPng.Decode(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := cgbi.Encode(&out); err != nil {
+		log.Fatal(err)
+	}
+
+	// The output is a standard PNG, which image/png can read.
+	img, err := png.Decode(&out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("size:", img.Bounds().Size())
+	fmt.Println("half transparent:", img.At(8, 2))
+	// Output:
+	// size: (16,16)
+	// half transparent: {128 32 199 128}
+}
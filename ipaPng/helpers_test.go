@@ -0,0 +1,184 @@
+package ipaPng
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testChunk is a chunk of a file built by the tests.
+type testChunk struct {
+	cType string
+	data  []byte
+}
+
+// cgbiChunk is the CgBI chunk Xcode writes for RGBA images.
+var cgbiChunk = testChunk{dsSeenCgBI, []byte{0x50, 0x00, 0x20, 0x06}}
+
+// buildPNG returns the PNG signature followed by chunks, with their CRCs.
+func buildPNG(chunks ...testChunk) []byte {
+	var b bytes.Buffer
+	b.WriteString(pngHeader)
+	for _, c := range chunks {
+		writeChunk(&b, c.cType, c.data)
+	}
+	return b.Bytes()
+}
+
+// splitPNG is the inverse of buildPNG, for files with valid lengths.
+func splitPNG(f []byte) []testChunk {
+	var chunks []testChunk
+	for p := len(pngHeader); p+12 <= len(f); {
+		n := int(binary.BigEndian.Uint32(f[p:]))
+		chunks = append(chunks, testChunk{string(f[p+4 : p+8]), f[p+8 : p+8+n]})
+		p += 12 + n
+	}
+	return chunks
+}
+
+// ihdrData returns the payload of an IHDR chunk.
+func ihdrData(width, height, depth, colorType, interlace int) []byte {
+	d := make([]byte, iHDRLength)
+	binary.BigEndian.PutUint32(d[0:], uint32(width))
+	binary.BigEndian.PutUint32(d[4:], uint32(height))
+	d[8], d[9], d[12] = byte(depth), byte(colorType), byte(interlace)
+	return d
+}
+
+// compress returns raw as a raw deflate stream for CgBI files and as a zlib
+// stream otherwise.
+func compress(raw []byte, cgbi bool) []byte {
+	var b bytes.Buffer
+	if cgbi {
+		w, _ := flate.NewWriter(&b, flate.BestCompression)
+		w.Write(raw)
+		w.Close()
+	} else {
+		w := zlib.NewWriter(&b)
+		w.Write(raw)
+		w.Close()
+	}
+	return b.Bytes()
+}
+
+// makeFile builds a file from scanlines that are already filtered, a CgBI
+// one with cgbi, with extra placed between IHDR and IDAT.
+func makeFile(width, height, depth, colorType, interlace int, raw []byte, cgbi bool, extra ...testChunk) []byte {
+	var chunks []testChunk
+	if cgbi {
+		chunks = append(chunks, cgbiChunk)
+	}
+	chunks = append(chunks, testChunk{dsSeenIHDR, ihdrData(width, height, depth, colorType, interlace)})
+	chunks = append(chunks, extra...)
+	chunks = append(chunks, testChunk{dsSeenIDAT, compress(raw, cgbi)}, testChunk{dsSeenIEND, nil})
+	return buildPNG(chunks...)
+}
+
+// testImage returns an opaque image with a different color in every pixel,
+// which survives the premultiplication of CgBI unchanged.
+func testImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 16), uint8(y * 16), uint8(x*7 + y*3), 0xff})
+		}
+	}
+	return img
+}
+
+// cgbiRows returns the scanlines of img in CgBI order, BGRA with filter
+// None, as Adam7 passes with interlace.
+func cgbiRows(img *image.NRGBA, interlace bool) []byte {
+	scans := []interlaceScan{{1, 1, 0, 0}}
+	if interlace {
+		scans = interlacing[:]
+	}
+	b := img.Bounds()
+	var raw []byte
+	for _, p := range scans {
+		for y := p.yOffset; y < b.Dy(); y += p.yFactor {
+			if p.xOffset >= b.Dx() {
+				break
+			}
+			raw = append(raw, ftNone)
+			for x := p.xOffset; x < b.Dx(); x += p.xFactor {
+				c := img.NRGBAAt(x, y)
+				raw = append(raw, c.B, c.G, c.R, c.A)
+			}
+		}
+	}
+	return raw
+}
+
+// makeCgBI builds an RGBA8 CgBI file of the opaque img.
+func makeCgBI(img *image.NRGBA, interlace bool, extra ...testChunk) []byte {
+	il := 0
+	if interlace {
+		il = 1
+	}
+	b := img.Bounds()
+	return makeFile(b.Dx(), b.Dy(), 8, ctTrueColorAlpha, il, cgbiRows(img, interlace), true, extra...)
+}
+
+// decodeBytes decodes f with opts, failing the test on errors.
+func decodeBytes(t testing.TB, f []byte, opts DecodeOptions) *IpaPNG {
+	t.Helper()
+	cgbi, err := DecodeWithOptions(bytes.NewReader(f), opts)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return cgbi
+}
+
+// sameImage reports the first pixel where got differs from want.
+func sameImage(t testing.TB, got image.Image, want *image.NRGBA) {
+	t.Helper()
+	if got.Bounds().Size() != want.Bounds().Size() {
+		t.Fatalf("size %v, want %v", got.Bounds().Size(), want.Bounds().Size())
+	}
+	gb, wb := got.Bounds(), want.Bounds()
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			g := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+			if w := want.NRGBAAt(wb.Min.X+x, wb.Min.Y+y); g != w {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
+
+// filterRows filters the rows of raw, unfiltered scanlines of rowLen bytes
+// with bpp bytes per pixel (1 below 8 bits), with filter type ft, and
+// returns them with their filter type bytes.
+func filterRows(raw []byte, rowLen, bpp int, ft byte) []byte {
+	var out []byte
+	prev := make([]byte, rowLen)
+	for y := 0; y+rowLen <= len(raw); y += rowLen {
+		cur := raw[y : y+rowLen]
+		out = append(out, ft)
+		for i, c := range cur {
+			var a, c2 byte
+			if i >= bpp {
+				a, c2 = cur[i-bpp], prev[i-bpp]
+			}
+			b := prev[i]
+			switch ft {
+			case ftSub:
+				c -= a
+			case ftUp:
+				c -= b
+			case ftAverage:
+				c -= byte((int(a) + int(b)) / 2)
+			case ftPaeth:
+				c -= paeth(a, b, c2)
+			}
+			out = append(out, c)
+		}
+		prev = cur
+	}
+	return out
+}
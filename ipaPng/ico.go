@@ -0,0 +1,111 @@
+package ipaPng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+)
+
+// icoPNGSize is the icon size from which entries are stored as PNG. Smaller
+// ones are bitmaps, which every version of Windows reads.
+const icoPNGSize = 256
+
+// EncodeICO writes the decoded images of icons to w as one Windows icon
+// (.ico) file, with an entry per image in the given order. Icons must be
+// from 1 to 256 pixels on each side and differ in size. 256 pixel icons are
+// stored PNG compressed, smaller ones as 32-bit bitmaps. Samples are stored
+// with 8 bits, so 16-bit images get a warning in their Warnings.
+func EncodeICO(w io.Writer, icons []*IpaPNG) error {
+	if len(icons) == 0 {
+		return errors.New("no images for the icon")
+	}
+	if len(icons) > 0xffff {
+		return errors.New(fmt.Sprintf("too many images for one icon: %d", len(icons)))
+	}
+	seen := make(map[image.Point]bool, len(icons))
+	entries := make([][]byte, len(icons))
+	for i, icon := range icons {
+		if icon.Img == nil {
+			return errors.New("no decoded image to encode")
+		}
+		size := icon.Img.Bounds().Size()
+		if size.X < 1 || size.Y < 1 || size.X > 256 || size.Y > 256 {
+			return errors.New(fmt.Sprintf("image %d is %dx%d, icons can be at most 256x256", i+1, size.X, size.Y))
+		}
+		if seen[size] {
+			return errors.New(fmt.Sprintf("image %d is %dx%d, like an earlier one", i+1, size.X, size.Y))
+		}
+		seen[size] = true
+		icon.warnDepth()
+		nRgba := toNRGBA(icon.Img)
+		if size.X >= icoPNGSize || size.Y >= icoPNGSize {
+			var b bytes.Buffer
+			if err := png.Encode(&b, nRgba); err != nil {
+				return err
+			}
+			entries[i] = b.Bytes()
+		} else {
+			entries[i] = icoBitmap(nRgba)
+		}
+	}
+
+	// ICONDIR, then an ICONDIRENTRY per image, then the image data.
+	header := make([]byte, 6+16*len(icons))
+	binary.LittleEndian.PutUint16(header[2:], 1) // type: icon
+	binary.LittleEndian.PutUint16(header[4:], uint16(len(icons)))
+	offset := len(header)
+	for i, icon := range icons {
+		size := icon.Img.Bounds().Size()
+		e := header[6+16*i:]
+		// 256 is stored as 0.
+		e[0], e[1] = uint8(size.X), uint8(size.Y)
+		binary.LittleEndian.PutUint16(e[4:], 1)  // color planes
+		binary.LittleEndian.PutUint16(e[6:], 32) // bits per pixel
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(entries[i])))
+		binary.LittleEndian.PutUint32(e[12:], uint32(offset))
+		offset += len(entries[i])
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := w.Write(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// icoBitmap returns img as the bitmap of an icon entry: a BITMAPINFOHEADER
+// of twice the height, the BGRA rows bottom up and then the AND mask, one
+// bit per pixel, set where the pixel is fully transparent.
+func icoBitmap(img *image.NRGBA) []byte {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	maskStride := (width + 31) / 32 * 4
+	b := make([]byte, 40+width*height*4+maskStride*height)
+	binary.LittleEndian.PutUint32(b[0:], 40)
+	binary.LittleEndian.PutUint32(b[4:], uint32(width))
+	binary.LittleEndian.PutUint32(b[8:], uint32(2*height)) // the color rows and the mask
+	binary.LittleEndian.PutUint16(b[12:], 1)
+	binary.LittleEndian.PutUint16(b[14:], 32)
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(b)-40))
+	pix := b[40:]
+	mask := b[40+width*height*4:]
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride:]
+		out := pix[(height-1-y)*width*4:]
+		maskRow := mask[(height-1-y)*maskStride:]
+		for x := 0; x < width; x++ {
+			p := row[x*4 : x*4+4]
+			out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = p[2], p[1], p[0], p[3]
+			if p[3] == 0 {
+				maskRow[x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	return b
+}
@@ -6,16 +6,17 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"hash"
 	"image"
 	"image/color"
 	"image/png"
 	"io"
+	"io/ioutil"
+	"time"
 )
 
 // 89 50 4E 47 0D 0A 1A 0A
-var pngHeader = "\x89\x50\x4E\x47\x0D\x0A\x1A\x0A"
-var iHDRLength uint32 = 13
+const pngHeader = "\x89\x50\x4E\x47\x0D\x0A\x1A\x0A"
+const iHDRLength uint32 = 13
 
 const (
 	dsStart    = ""
@@ -63,7 +64,7 @@ type interlaceScan struct {
 
 // interlacing defines Adam7 interlacing, with 7 passes of reduced images.
 // See https://www.w3.org/TR/PNG/#8Interlace
-var interlacing = []interlaceScan{
+var interlacing = [7]interlaceScan{
 	{8, 8, 0, 0},
 	{8, 8, 4, 0},
 	{4, 8, 0, 4},
@@ -73,13 +74,24 @@ var interlacing = []interlaceScan{
 	{1, 2, 0, 1},
 }
 
-var chunkOrderError = errors.New("chunk out of order")
+// misplaced returns the ChunkOrderError for the chunk at idx of type cType,
+// met while stage, the last of IHDR, IDAT and IEND seen, is the current one.
+func misplaced(cType, stage string, idx int) error {
+	e := &ChunkOrderError{Chunk: cType, Relation: "after", Other: stage, Index: idx}
+	switch {
+	case stage == dsStart:
+		e.Relation, e.Other = "before", dsSeenIHDR
+	case cType == dsSeenIEND && stage == dsSeenIHDR:
+		e.Relation, e.Other = "before", dsSeenIDAT
+	}
+	return stageError(StageChunk, e)
+}
 
 type IpaPNG struct {
 	Img               image.Image
 	r                 io.ReadSeeker
-	crc               hash.Hash32
 	IsCgBI            bool
+	CgBIFlags         uint32 // payload of the CgBI chunk
 	width             int
 	height            int
 	depth             int
@@ -93,6 +105,70 @@ type IpaPNG struct {
 	idatLength        int
 	stage             int
 	buf               [8]byte
+	opts              DecodeOptions
+	warnings          []string
+	palette           color.Palette
+	unpremultiplied   bool
+	timings           map[string]time.Duration // nil unless instrumenting
+}
+
+// Warnings returns the non-fatal problems noticed while decoding, followed
+// by those of the encoders, e.g. information a target format can't hold.
+func (cgbi *IpaPNG) Warnings() []string {
+	return cgbi.warnings
+}
+
+// Unpremultiplied reports whether decoding had to divide any colors by
+// alpha, i.e. whether the CgBI source held a pixel that is neither opaque
+// nor black and fully transparent. For such files the premultiply fix
+// actually changed something. It is always false for the CgBI variant whose
+// flags mark straight alpha, which is left alone.
+func (cgbi *IpaPNG) Unpremultiplied() bool {
+	return cgbi.unpremultiplied
+}
+
+// warn records a non-fatal problem, once even when encoding the image more
+// than once runs into it again.
+func (cgbi *IpaPNG) warn(format string, a ...interface{}) {
+	w := fmt.Sprintf(format, a...)
+	for _, seen := range cgbi.warnings {
+		if seen == w {
+			return
+		}
+	}
+	cgbi.warnings = append(cgbi.warnings, w)
+}
+
+// FromImage returns an IpaPNG holding img, with the header fields derived
+// from its bounds and color model, ready for Encode or EncodeCgBI.
+func FromImage(img image.Image) *IpaPNG {
+	b := img.Bounds()
+	cgbi := &IpaPNG{
+		Img:    img,
+		width:  b.Dx(),
+		height: b.Dy(),
+		depth:  8,
+	}
+	switch img.ColorModel() {
+	case color.GrayModel:
+		cgbi.colorType = ctGrayscale
+	case color.Gray16Model:
+		cgbi.colorType, cgbi.depth = ctGrayscale, 16
+	case color.RGBA64Model, color.NRGBA64Model:
+		cgbi.colorType, cgbi.depth = ctTrueColorAlpha, 16
+	default:
+		cgbi.colorType = ctTrueColorAlpha
+	}
+	if _, ok := img.ColorModel().(color.Palette); ok {
+		cgbi.colorType = ctPaletted
+	}
+	switch cgbi.colorType {
+	case ctGrayscale, ctPaletted:
+		cgbi.bitsPerPixel = cgbi.depth
+	case ctTrueColorAlpha:
+		cgbi.bitsPerPixel = cgbi.depth * 4
+	}
+	return cgbi
 }
 
 // PrintChunks will return a string containign chunk number, name and the first 20
@@ -114,11 +190,88 @@ func (cgbi IpaPNG) PrintChunks() string {
 	return output
 }
 
+// Width returns the image width declared in IHDR.
+func (cgbi *IpaPNG) Width() int { return cgbi.width }
+
+// Height returns the image height declared in IHDR.
+func (cgbi *IpaPNG) Height() int { return cgbi.height }
+
+// Depth returns the bit depth declared in IHDR.
+func (cgbi *IpaPNG) Depth() int { return cgbi.depth }
+
+// ColorType returns the PNG color type declared in IHDR.
+func (cgbi *IpaPNG) ColorType() int { return cgbi.colorType }
+
+// Interlace returns the interlace method declared in IHDR, 0 (none) or 1 (Adam7).
+func (cgbi *IpaPNG) Interlace() int { return int(cgbi.interlace) }
+
+// HasAlpha reports whether the image carries alpha, either as a color type
+// with an alpha channel or through a tRNS chunk.
+func (cgbi *IpaPNG) HasAlpha() bool {
+	if cgbi.colorType == ctGrayscaleAlpha || cgbi.colorType == ctTrueColorAlpha {
+		return true
+	}
+	return cgbi.findChunk("tRNS") != nil
+}
+
+// findChunk returns the first chunk of type cType, or nil.
+func (cgbi *IpaPNG) findChunk(cType string) *Chunk {
+	for _, c := range cgbi.chunks {
+		if c.CType == cType {
+			return c
+		}
+	}
+	return nil
+}
+
+// DPI returns the physical resolution from the pHYs chunk, converted from
+// pixels per meter to dots per inch. ok is false when there is no pHYs chunk
+// or its unit is not the meter.
+func (cgbi *IpaPNG) DPI() (x, y float64, ok bool) {
+	c := cgbi.findChunk("pHYs")
+	if c == nil || len(c.Data) != 9 || c.Data[8] != 1 {
+		return 0, 0, false
+	}
+	x = float64(binary.BigEndian.Uint32(c.Data[0:4])) * 0.0254
+	y = float64(binary.BigEndian.Uint32(c.Data[4:8])) * 0.0254
+	return x, y, true
+}
+
+// ChunkCount returns the number of chunks read from the file, IEND included.
+func (cgbi *IpaPNG) ChunkCount() int { return len(cgbi.chunks) }
+
+// ChunkTypes returns the types of the chunks read from the file, in file
+// order and IEND included.
+func (cgbi *IpaPNG) ChunkTypes() []string {
+	types := make([]string, len(cgbi.chunks))
+	for i, c := range cgbi.chunks {
+		types[i] = c.CType
+	}
+	return types
+}
+
+// IDATSize returns the total compressed size of all IDAT chunks.
+func (cgbi *IpaPNG) IDATSize() int { return cgbi.idatLength }
+
+// IHDRBytes returns the 13 byte IHDR payload for the parsed header fields,
+// as it would be serialized in a file.
+func (cgbi *IpaPNG) IHDRBytes() []byte {
+	b := make([]byte, iHDRLength)
+	binary.BigEndian.PutUint32(b[0:4], uint32(cgbi.width))
+	binary.BigEndian.PutUint32(b[4:8], uint32(cgbi.height))
+	b[8] = uint8(cgbi.depth)
+	b[9] = uint8(cgbi.colorType)
+	b[10] = uint8(cgbi.CompressionMethod)
+	b[11] = uint8(cgbi.FilterMethod)
+	b[12] = uint8(cgbi.interlace)
+	return b
+}
+
 // Parse IHDR chunk.
 // https://golang.org/src/image/png/reader.go?#L142 is your friend.
 func (cgbi *IpaPNG) parseIHDR(iHDR *Chunk) error {
 	if iHDR.Length != iHDRLength {
-		errString := fmt.Sprintf("invalid IHDR length: got %cgbi - expected %cgbi",
+		errString := fmt.Sprintf("invalid IHDR length: got %d - expected %d",
 			iHDR.Length, iHDRLength)
 		return errors.New(errString)
 	}
@@ -134,21 +287,35 @@ func (cgbi *IpaPNG) parseIHDR(iHDR *Chunk) error {
 	// Interlace method:   1 byte
 
 	tmp := iHDR.Data
+	// Length and Data agree after Populate, but don't index past the data
+	// if a chunk was built some other way.
+	if len(tmp) < int(iHDRLength) {
+		return errors.New(fmt.Sprintf("invalid IHDR data: got %d bytes - expected %d",
+			len(tmp), iHDRLength))
+	}
 
+	// The spec caps both at 2^31-1, which also keeps them positive in a
+	// 32-bit int.
 	cgbi.width = int(binary.BigEndian.Uint32(tmp[0:4]))
-	if cgbi.width <= 0 {
+	if cgbi.width <= 0 || tmp[0] >= 0x80 {
 		errString := fmt.Sprintf("invalid width in iHDR - got %x", tmp[0:4])
 		return errors.New(errString)
 	}
 
 	cgbi.height = int(binary.BigEndian.Uint32(tmp[4:8]))
-	if cgbi.height <= 0 {
+	if cgbi.height <= 0 || tmp[4] >= 0x80 {
 		errString := fmt.Sprintf("invalid height in iHDR - got %x", tmp[4:8])
 		return errors.New(errString)
 	}
 
 	cgbi.depth = int(tmp[8])
 	cgbi.colorType = int(tmp[9])
+	if cgbi.opts.ForceDepth != nil {
+		cgbi.depth = *cgbi.opts.ForceDepth
+	}
+	if cgbi.opts.ForceColorType != nil {
+		cgbi.colorType = *cgbi.opts.ForceColorType
+	}
 	cb := cbInvalid
 	switch cgbi.colorType {
 	case ctGrayscale:
@@ -178,7 +345,7 @@ func (cgbi *IpaPNG) parseIHDR(iHDR *Chunk) error {
 		cgbi.bitsPerPixel = cgbi.depth * 4
 	}
 	if cb == cbInvalid {
-		return errors.New(fmt.Sprintf("bit depth %cgbi, color type %cgbi", cgbi.depth, cgbi.colorType))
+		return errors.New(fmt.Sprintf("invalid bit depth %d for color type %d", cgbi.depth, cgbi.colorType))
 	}
 
 	// Only compression method 0 is supported
@@ -197,28 +364,119 @@ func (cgbi *IpaPNG) parseIHDR(iHDR *Chunk) error {
 	}
 	cgbi.FilterMethod = uint32(tmp[11])
 
+	interlace := int(tmp[12])
+	if cgbi.opts.ForceInterlace != nil {
+		interlace = *cgbi.opts.ForceInterlace
+	}
 	// Only interlace methods 0 and 1 are supported
-	if uint32(tmp[12]) != 0 && uint32(tmp[12]) != 1 {
+	if interlace != 0 && interlace != 1 {
 		errString := fmt.Sprintf("invalid interlace method - expected 0 or 1 - got %x",
-			tmp[12])
+			interlace)
 		return errors.New(errString)
 	}
-	cgbi.interlace = uint32(tmp[12])
+	cgbi.interlace = uint32(interlace)
+
+	return nil
+}
+
+// parsePLTE reads the palette of a paletted image. Other color types may
+// carry a suggested palette, which is of no use here.
+func (cgbi *IpaPNG) parsePLTE(PLTE *Chunk) error {
+	n := len(PLTE.Data) / 3
+	if len(PLTE.Data)%3 != 0 || n == 0 || n > 256 || n > 1<<uint(cgbi.depth) && cgbi.colorType == ctPaletted {
+		return errors.New(fmt.Sprintf("invalid PLTE length: %d", len(PLTE.Data)))
+	}
+	if cgbi.colorType != ctPaletted {
+		return nil
+	}
+	cgbi.palette = make(color.Palette, n)
+	for i := range cgbi.palette {
+		d := PLTE.Data[3*i:]
+		cgbi.palette[i] = color.NRGBA{d[0], d[1], d[2], 0xff}
+	}
+	return nil
+}
 
+// checkPaletteIndices fails on the indices in pix past the end of the
+// palette, or clamps them to its last entry with ClampPaletteIndex.
+func (cgbi *IpaPNG) checkPaletteIndices(pix []uint8) error {
+	n := len(cgbi.palette)
+	if n >= 1<<uint(cgbi.depth) {
+		return nil
+	}
+	last := uint8(n - 1)
+	for x, i := range pix {
+		if i <= last {
+			continue
+		}
+		if !cgbi.opts.ClampPaletteIndex {
+			return errors.New(fmt.Sprintf("palette index %d out of range: PLTE has %d entries", i, n))
+		}
+		pix[x] = last
+		cgbi.warn("clamped palette indices past the %d PLTE entries to the last one", n)
+	}
+	return nil
+}
+
+// parsetRNS applies the alpha values of a paletted image to its palette.
+func (cgbi *IpaPNG) parsetRNS(tRNS *Chunk) error {
+	if cgbi.colorType != ctPaletted {
+		return nil
+	}
+	if len(tRNS.Data) > len(cgbi.palette) {
+		return errors.New(fmt.Sprintf("invalid tRNS length: %d", len(tRNS.Data)))
+	}
+	for i, a := range tRNS.Data {
+		c := cgbi.palette[i].(color.NRGBA)
+		c.A = a
+		cgbi.palette[i] = c
+	}
 	return nil
 }
 
+// Histogram returns the entries of the hIST chunk, the approximate usage
+// frequency of each palette entry. ok is false when there is no hIST chunk.
+func (cgbi *IpaPNG) Histogram() ([]uint16, bool) {
+	c := cgbi.findChunk("hIST")
+	if c == nil {
+		return nil, false
+	}
+	hist := make([]uint16, len(c.Data)/2)
+	for i := range hist {
+		hist[i] = binary.BigEndian.Uint16(c.Data[2*i:])
+	}
+	return hist, true
+}
+
 func (cgbi *IpaPNG) parseIDAT(IDAT *Chunk) (err error) {
+	// Apple tools sometimes emit empty IDAT chunks between the real ones. They
+	// carry nothing, so they are simply skipped and still count as IDAT for
+	// the chunk order.
+	if IDAT.Length == 0 {
+		return
+	}
+	if cgbi.opts.SkipIDAT {
+		cgbi.idatLength += int(IDAT.Length)
+		return
+	}
 	cgbi.IDAT = append(cgbi.IDAT, IDAT.Data...)
+	cgbi.idatLength += len(IDAT.Data)
 	return
 }
 
-func (cgbi *IpaPNG) checkHeader() error {
-	_, err := io.ReadFull(cgbi.r, cgbi.buf[:len(pngHeader)])
-	if err != nil {
+func checkHeader(r io.Reader) error {
+	buf := make([]byte, len(pngHeader))
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil:
+	case io.EOF:
+		return ErrEmptyInput
+	case io.ErrUnexpectedEOF:
+		return errors.New(fmt.Sprintf("truncated PNG signature, only %d of %d bytes", n, len(pngHeader)))
+	default:
 		return err
 	}
-	if string(cgbi.buf[:len(pngHeader)]) != pngHeader {
+	if string(buf) != pngHeader {
 		return errors.New("not a PNG file")
 	}
 	return nil
@@ -226,42 +484,103 @@ func (cgbi *IpaPNG) checkHeader() error {
 
 func (cgbi *IpaPNG) parseChunk() error {
 	if len(cgbi.chunks) == 0 {
-		return errors.New("not got any chunk")
+		return stageError(StageChunk, errors.New("not got any chunk"))
 	}
 
 	if cgbi.chunks[0].CType != dsSeenCgBI {
 		cgbi.IsCgBI = false
-		cgbi.chunks = []*Chunk{}
+		// Only collect the header fields, the image itself is decoded by image/png.
+		for _, chunk := range cgbi.chunks {
+			switch chunk.CType {
+			case dsSeenIHDR:
+				if err := cgbi.parseIHDR(chunk); err != nil {
+					return stageError(StageIHDR, err)
+				}
+			case dsSeenIDAT:
+				cgbi.idatLength += int(chunk.Length)
+			}
+		}
+		if cgbi.opts.SkipIDAT {
+			return nil
+		}
 		cgbi.r.Seek(0, io.SeekStart)
 		var err error
-		cgbi.Img, err = png.Decode(cgbi.r)
-		return err
+		start := cgbi.clock()
+		if cgbi.opts.ChunkRewriter != nil || cgbi.opts.IgnoreCRC {
+			// Decode what the rewriter made of the file, not the original,
+			// and with valid CRCs, which image/png insists on.
+			var b bytes.Buffer
+			if err = WriteChunks(&b, cgbi.chunks); err != nil {
+				return stageError(StagePNG, err)
+			}
+			cgbi.Img, err = png.Decode(&b)
+		} else {
+			cgbi.Img, err = png.Decode(cgbi.r)
+		}
+		cgbi.lap(PhasePNG, &start)
+		if err != nil {
+			// Say which path failed; the error of image/png stays
+			// reachable for errors.As, e.g. as a png.FormatError.
+			return stageError(StagePNG, fmt.Errorf("input is not CgBI and image/png failed to decode it: %w", err))
+		}
+		if cgbi.opts.OnRow != nil {
+			emitRows(cgbi.Img, cgbi.opts.OnRow)
+			cgbi.Img = nil
+		}
+		return nil
 	}
 
+	if len(cgbi.chunks[0].Data) == 4 {
+		cgbi.CgBIFlags = binary.BigEndian.Uint32(cgbi.chunks[0].Data)
+	}
+	cgbi.IsCgBI = true
+
 	stage := dsStart
 	for idx := 1; idx < len(cgbi.chunks); idx++ {
 		var err error
 		chunk := cgbi.chunks[idx]
 		// Read the chunk data.
 		switch chunk.CType {
+		case dsSeenCgBI:
+			// Only the first CgBI chunk counts, later ones are malformed leftovers.
+			cgbi.warn("ignoring duplicate CgBI chunk #%d", idx)
 		case dsSeenIHDR:
 			if stage != dsStart {
-				return chunkOrderError
+				return misplaced(chunk.CType, stage, idx)
 			}
 			stage = dsSeenIHDR
-			err = cgbi.parseIHDR(chunk)
+			err = stageError(StageIHDR, cgbi.parseIHDR(chunk))
+		case "PLTE":
+			if cgbi.palette != nil {
+				return misplaced(chunk.CType, chunk.CType, idx)
+			}
+			if stage != dsSeenIHDR {
+				return misplaced(chunk.CType, stage, idx)
+			}
+			err = stageError(StageIHDR, cgbi.parsePLTE(chunk))
+		case "tRNS":
+			if stage != dsSeenIHDR {
+				return misplaced(chunk.CType, stage, idx)
+			}
+			err = stageError(StageIHDR, cgbi.parsetRNS(chunk))
 		case dsSeenIDAT:
+			if stage == dsSeenIHDR && cgbi.colorType == ctPaletted && cgbi.palette == nil {
+				return stageError(StageChunk, errors.New("missing PLTE chunk"))
+			}
 			if stage != dsSeenIHDR && stage != dsSeenIDAT {
-				return chunkOrderError
+				return misplaced(chunk.CType, stage, idx)
 			}
 			stage = dsSeenIDAT
-			err = cgbi.parseIDAT(chunk)
+			err = stageError(StageIDAT, cgbi.parseIDAT(chunk))
 		case dsSeenIEND:
 			if stage != dsSeenIDAT {
-				return chunkOrderError
+				return misplaced(chunk.CType, stage, idx)
 			}
 			stage = dsSeenIEND
-			cgbi.Img, err = cgbi.decode()
+			if !cgbi.opts.SkipIDAT {
+				cgbi.Img, err = cgbi.decode()
+				err = stageError(StageIDAT, err)
+			}
 		default: // not parse
 		}
 		if err != nil {
@@ -269,75 +588,238 @@ func (cgbi *IpaPNG) parseChunk() error {
 		}
 	}
 	if stage != dsSeenIEND {
-		return errors.New("the file can not found IEND chunk")
+		return stageError(StageChunk, errors.New("the file can not found IEND chunk"))
 	}
 	return nil
 }
 
 // decode decodes the IDAT data into an image.
 func (cgbi *IpaPNG) decode() (image.Image, error) {
+	// Without any IDAT data only the zlib header seeded by the reader is left.
+	if cgbi.idatLength == 0 {
+		return nil, errors.New("no image data, all IDAT chunks are empty")
+	}
 	b := bytes.NewReader(cgbi.IDAT)
 	r, err := zlib.NewReader(b)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
+	cr := &countingReader{r: r}
+	if cgbi.exceedsIDAT() {
+		// Count what IDAT holds for the error, which is cheap, as there
+		// is little of it.
+		io.Copy(ioutil.Discard, cr)
+		return nil, cgbi.dimensionError(cr.n)
+	}
+	img, err := cgbi.decodePasses(cr)
+	if err == errNotEnoughPixelData {
+		// The inflater ran dry, so everything IDAT holds has been counted.
+		return nil, cgbi.dimensionError(cr.n)
+	}
+	if err == nil && cgbi.opts.StrictRowCount && (cgbi.opts.MaxRows <= 0 || cgbi.opts.MaxRows >= cgbi.height) {
+		// Count what is left; as above, a truncated tail is no error.
+		if n, _ := io.Copy(ioutil.Discard, cr); n > 0 {
+			return nil, cgbi.dimensionError(cr.n)
+		}
+	}
+	if err == nil && cgbi.opts.VerifyChecksum {
+		start := cgbi.clock()
+		err = cgbi.verifyChecksum()
+		cgbi.lap(PhaseChecksum, &start)
+	}
+	return img, err
+}
+
+// PassImages returns the seven reduced images of an Adam7 interlaced CgBI
+// file, in pass order and before they are merged, which helps to see how
+// interlacing spreads the pixels. A pass that is empty for a small image
+// is nil. Other files give an error.
+func (cgbi *IpaPNG) PassImages() ([]image.Image, error) {
+	if !cgbi.IsCgBI || cgbi.interlace != itAdam7 {
+		return nil, errors.New("not an interlaced CgBI image")
+	}
+	r, err := zlib.NewReader(bytes.NewReader(cgbi.IDAT))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	passes := make([]image.Image, 7)
+	rowBuf := cgbi.newRowBuffer()
+	for pass := range passes {
+		img, err := cgbi.readImagePass(r, pass, false, rowBuf)
+		if err != nil {
+			return nil, err
+		}
+		// Keep empty passes a plain nil, not a nil image.Image.
+		if img != nil {
+			passes[pass] = img
+		}
+	}
+	return passes, nil
+}
+
+// decodePasses reads the image, or every Adam7 pass of it, from r.
+func (cgbi *IpaPNG) decodePasses(r io.Reader) (image.Image, error) {
 	var img image.Image
+	var err error
 	//fmt.Printf("do decode,interlace:%v\n", cgbi.interlace)
+	// The row buffers are sized for the full width and shared by all passes.
+	rowBuf := cgbi.newRowBuffer()
 	if cgbi.interlace == itNone {
-		img, err = cgbi.readImagePass(r, 0, false)
+		img, err = cgbi.readImagePass(r, 0, false, rowBuf)
 		if err != nil {
 			return nil, err
 		}
 	} else if cgbi.interlace == itAdam7 {
+		if cgbi.opts.MaxRows > 0 {
+			return nil, errors.New("MaxRows is not supported for interlaced images")
+		}
+		if cgbi.opts.OnRow != nil {
+			return nil, errors.New("OnRow is not supported for interlaced images")
+		}
 		// Allocate a blank image of the full size.
-		img, err = cgbi.readImagePass(nil, 0, true)
+		img, err = cgbi.readImagePass(nil, 0, true, nil)
 		if err != nil {
 			return nil, err
 		}
 		for pass := 0; pass < 7; pass++ {
-			imagePass, err := cgbi.readImagePass(r, pass, false)
+			imagePass, err := cgbi.readImagePass(r, pass, false, rowBuf)
 			if err != nil {
 				return nil, err
 			}
 			if imagePass != nil {
+				start := cgbi.clock()
 				cgbi.mergePassInto(img, imagePass, pass)
+				cgbi.lap(PhaseConvert, &start)
 			}
 		}
 	}
 
-	// Check for EOF, to verify the zlib checksum.
-	//n := 0
-	//for i := 0; n == 0 && err == nil; i++ {
-	//	if i == 100 {
-	//		return nil, io.ErrNoProgress
-	//	}
-	//	n, err = r.Read(cgbi.buf[:1])
-	//}
-	//if err != nil && err != io.EOF {
-	//	return nil, err
-	//}
-	//if n != 0 {
-	//	return nil, errors.New("too much pixel data")
-	//}
+	// Nothing is read past the last row on purpose. Some CgBI streams end
+	// with padding or lack a final deflate block, which makes the inflater
+	// report io.ErrUnexpectedEOF near the tail. Once every row was read the
+	// image is complete, so that trailing error is not worth failing for.
+	// DecodeOptions.StrictRowCount opts into checking for leftover rows.
 
 	return img, nil
 }
 
-// readImagePass reads a single image pass, sized according to the pass number.
-func (cgbi *IpaPNG) readImagePass(r io.Reader, pass int, allocateOnly bool) (image.Image, error) {
+// errNotEnoughPixelData is returned by readImagePass when the data runs out
+// before the last row; decode turns it into a DimensionError.
+var errNotEnoughPixelData = errors.New("not enough pixel data")
+
+// pixelDataSize returns the number of inflated IDAT bytes, filter type bytes
+// included, that the dimensions declared in IHDR call for. A size that
+// doesn't fit in an int, which a corrupt IHDR can declare, is capped.
+func (cgbi *IpaPNG) pixelDataSize() int {
+	const maxInt = uint64(^uint(0) >> 1)
+	size := uint64(0)
+	add := func(width, height int) {
+		rowSize := 1 + (uint64(cgbi.bitsPerPixel)*uint64(width)+7)/8
+		if rowSize > maxInt/uint64(height) {
+			size = maxInt
+			return
+		}
+		if size += rowSize * uint64(height); size > maxInt {
+			size = maxInt
+		}
+	}
+	if cgbi.interlace == itNone {
+		add(cgbi.width, cgbi.height)
+	} else {
+		for pass := 0; pass < 7; pass++ {
+			width, height := passSize(cgbi.width, cgbi.height, pass)
+			if width > 0 && height > 0 {
+				add(width, height)
+			}
+		}
+	}
+	return int(size)
+}
+
+// maxInflateRatio is the most deflate can expand its input: a stream of
+// 258 byte matches takes about one bit per 4 bytes of output.
+const maxInflateRatio = 1032
+
+// exceedsIDAT reports whether the image declared in IHDR needs more pixel
+// data than IDAT could possibly inflate to, as with a corrupt width or
+// height. Decoding it would allocate the image before finding that out.
+// With MaxRows only the rows decoded count.
+func (cgbi *IpaPNG) exceedsIDAT() bool {
+	limit := maxInflateRatio * uint64(cgbi.idatLength)
+	if cgbi.interlace == itNone && cgbi.opts.MaxRows > 0 && cgbi.opts.MaxRows < cgbi.height {
+		rowSize := 1 + (uint64(cgbi.bitsPerPixel)*uint64(cgbi.width)+7)/8
+		return rowSize > limit/uint64(cgbi.opts.MaxRows)
+	}
+	return uint64(cgbi.pixelDataSize()) > limit
+}
+
+// dimensionError describes IDAT data running out after available bytes.
+func (cgbi *IpaPNG) dimensionError(available int) *DimensionError {
+	e := &DimensionError{
+		Width:     cgbi.width,
+		Height:    cgbi.height,
+		Expected:  cgbi.pixelDataSize(),
+		Available: available,
+	}
+	// Only the rows of a non-interlaced image map directly onto the data.
+	if cgbi.interlace == itNone {
+		e.InferredHeight = available / (1 + (cgbi.bitsPerPixel*cgbi.width+7)/8)
+	}
+	return e
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// passSize returns the size of the reduced image for an Adam7 pass.
+// Passes whose offset lies outside of a tiny image (e.g. 1x1 or 3x1) are
+// empty, so width or height may be zero, but never negative.
+func passSize(width, height, pass int) (int, int) {
+	p := interlacing[pass]
+	return passLength(width, p.xOffset, p.xFactor), passLength(height, p.yOffset, p.yFactor)
+}
+
+// passLength returns how many of n columns or rows a pass takes, every
+// factor-th one from offset on. Rounding up as (n-offset+factor-1)/factor
+// would overflow for n close to the largest int, which a 32-bit build
+// reaches with a corrupt IHDR, so it is computed without going above n.
+func passLength(n, offset, factor int) int {
+	if n <= offset {
+		return 0
+	}
+	return (n-offset-1)/factor + 1
+}
+
+// newRowBuffer returns a buffer for readImagePass, big enough for the
+// current and previous row of a full width scanline with its filter byte.
+func (cgbi *IpaPNG) newRowBuffer() []uint8 {
+	return make([]uint8, 2*(1+(cgbi.bitsPerPixel*cgbi.width+7)/8))
+}
+
+// readImagePass reads a single image pass, sized according to the pass
+// number. rowBuf, from newRowBuffer, holds the rows while unfiltering.
+func (cgbi *IpaPNG) readImagePass(r io.Reader, pass int, allocateOnly bool, rowBuf []uint8) (image.Image, error) {
 	pixOffset := 0
 	var (
-		nRgba   *image.NRGBA
-		nRgba64 *image.NRGBA64
-		img     image.Image
+		nRgba    *image.NRGBA
+		nRgba64  *image.NRGBA64
+		paletted *image.Paletted
+		img      image.Image
 	)
 	width, height := cgbi.width, cgbi.height
 	if cgbi.interlace == itAdam7 && !allocateOnly {
-		p := interlacing[pass]
-		// Add the multiplication factor and subtract one, effectively rounding up.
-		width = (width - p.xOffset + p.xFactor - 1) / p.xFactor
-		height = (height - p.yOffset + p.yFactor - 1) / p.yFactor
+		width, height = passSize(width, height, pass)
 		// A PNG image can't have zero width or height, but for an interlaced
 		// image, an individual pass might have zero width or height. If so, we
 		// shouldn't even read a per-row filter type byte, so return early.
@@ -345,12 +827,31 @@ func (cgbi *IpaPNG) readImagePass(r io.Reader, pass int, allocateOnly bool) (ima
 			return nil, nil
 		}
 	}
+	// An anomaly here would otherwise panic when allocating the image below.
+	if width < 0 || height < 0 {
+		return nil, errors.New(fmt.Sprintf("invalid size %dx%d for pass %d", width, height, pass))
+	}
+	if cgbi.interlace == itNone && cgbi.opts.MaxRows > 0 && cgbi.opts.MaxRows < height {
+		height = cgbi.opts.MaxRows
+	}
+	// With OnRow every row is decoded into the same image of a single row
+	// and passed on from there, so the full image is never allocated.
+	onRow := cgbi.opts.OnRow
+	var row []color.NRGBA
+	imgHeight := height
+	if onRow != nil && !allocateOnly {
+		row = make([]color.NRGBA, width)
+		imgHeight = 1
+	}
 	//fmt.Printf("readImagePass width:%v, height:%v, colorType:%v, depth:%v\n", width, height, cgbi.colorType, cgbi.depth)
-	if cgbi.depth == 16 {
-		nRgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
+	if cgbi.colorType == ctPaletted {
+		paletted = image.NewPaletted(image.Rect(0, 0, width, imgHeight), cgbi.palette)
+		img = paletted
+	} else if cgbi.depth == 16 {
+		nRgba64 = image.NewNRGBA64(image.Rect(0, 0, width, imgHeight))
 		img = nRgba64
 	} else {
-		nRgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		nRgba = image.NewNRGBA(image.Rect(0, 0, width, imgHeight))
 		img = nRgba
 	}
 
@@ -358,23 +859,51 @@ func (cgbi *IpaPNG) readImagePass(r io.Reader, pass int, allocateOnly bool) (ima
 		return img, nil
 	}
 	bytesPerPixel := (cgbi.bitsPerPixel + 7) / 8
+	// ri and bi are the sample indexes of red and blue in a pixel.
+	ri, bi := 0, 2
+	if cgbi.bgr() {
+		ri, bi = 2, 0
+	}
 
 	// The +1 is for the per-row filter type, which is at cr[0].
 	rowSize := 1 + (cgbi.bitsPerPixel*width+7)/8
 	// cr and pr are the bytes for the current and previous row.
-	cr := make([]uint8, rowSize)
-	pr := make([]uint8, rowSize)
+	cr := rowBuf[:rowSize]
+	pr := rowBuf[rowSize : 2*rowSize]
+	// The row above the first one counts as zeros for the filters.
+	for i := range pr {
+		pr[i] = 0
+	}
 
+	start := cgbi.clock()
 	for y := 0; y < height; y++ {
+		// imgY is the row of img that y goes to.
+		imgY := y
+		if onRow != nil {
+			imgY, pixOffset = 0, 0
+		}
 		// Read the decompressed bytes.
+		// ReadFull reports no error once the row is complete, even when the
+		// inflater hit a broken tail right after it.
 		_, err := io.ReadFull(r, cr)
 		if err != nil {
-			fmt.Printf("readImagePass read error:%v", err)
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return nil, errors.New("not enough pixel data")
+				if cgbi.opts.InferHeight && cgbi.interlace == itNone && y > 0 {
+					// Keep the complete rows, as if IHDR declared that height.
+					cgbi.warn("IHDR declares a height of %d but IDAT only holds %d rows", cgbi.height, y)
+					cgbi.height = y
+					if onRow != nil {
+						return nil, nil
+					}
+					return img.(interface {
+						SubImage(image.Rectangle) image.Image
+					}).SubImage(image.Rect(0, 0, width, y)), nil
+				}
+				return nil, errNotEnoughPixelData
 			}
 			return nil, err
 		}
+		cgbi.lap(PhaseInflate, &start)
 
 		// Apply the filter.
 		cDat := cr[1:]
@@ -405,66 +934,257 @@ func (cgbi *IpaPNG) readImagePass(r io.Reader, pass int, allocateOnly bool) (ima
 		default:
 			return nil, errors.New("bad filter type")
 		}
+		cgbi.lap(PhaseDefilter, &start)
 
 		// Convert from bytes to colors.
+		if paletted != nil {
+			// Unpack the palette indices, depth bits each.
+			pix := paletted.Pix[pixOffset : pixOffset+width]
+			if cgbi.depth == 8 {
+				copy(pix, cDat)
+			} else {
+				perByte := 8 / cgbi.depth
+				mask := uint8(1<<uint(cgbi.depth) - 1)
+				for x := range pix {
+					shift := uint(8 - cgbi.depth - x%perByte*cgbi.depth)
+					pix[x] = cDat[x/perByte] >> shift & mask
+				}
+			}
+			if err := cgbi.checkPaletteIndices(pix); err != nil {
+				return nil, err
+			}
+			pixOffset += paletted.Stride
+			cgbi.lap(PhaseConvert, &start)
+			if onRow != nil {
+				onRow(y, nrgbaRow(img, row))
+				start = cgbi.clock()
+			}
+			pr, cr = cr, pr
+			continue
+		}
 		switch cgbi.depth {
 		case 1:
+			pix := nRgba.Pix[pixOffset:]
 			for x := 0; x < width; x += 8 {
 				b := cDat[x/8]
 				for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
 					yCol := (b >> 7) * 0xff
-					aCol := uint8(0xff)
-					nRgba.SetNRGBA(x+x2, y, color.NRGBA{yCol, yCol, yCol, aCol})
+					i := (x + x2) * 4
+					pix[i+0], pix[i+1], pix[i+2], pix[i+3] = yCol, yCol, yCol, 0xff
 					b <<= 1
 				}
 			}
+			pixOffset += nRgba.Stride
 		case 2:
+			pix := nRgba.Pix[pixOffset:]
 			for x := 0; x < width; x += 4 {
 				b := cDat[x/4]
 				for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
-					ycol := (b >> 6) * 0x55
-					acol := uint8(0xff)
-					nRgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
+					yCol := (b >> 6) * 0x55
+					i := (x + x2) * 4
+					pix[i+0], pix[i+1], pix[i+2], pix[i+3] = yCol, yCol, yCol, 0xff
 					b <<= 2
 				}
 			}
+			pixOffset += nRgba.Stride
 		case 4:
+			pix := nRgba.Pix[pixOffset:]
 			for x := 0; x < width; x += 2 {
 				b := cDat[x/2]
 				for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
-					ycol := (b >> 4) * 0x11
-					acol := uint8(0xff)
-					nRgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
+					yCol := (b >> 4) * 0x11
+					i := (x + x2) * 4
+					pix[i+0], pix[i+1], pix[i+2], pix[i+3] = yCol, yCol, yCol, 0xff
 					b <<= 4
 				}
 			}
+			pixOffset += nRgba.Stride
 		case 8:
-			//for x := 0; x < width; x++ {
-			//	ycol := cDat[2*x+0]
-			//	nRgba.SetNRGBA(x, y, color.NRGBA{ycol, ycol, ycol, cDat[2*x+1]})
-			//}
-			for x := 0; x < width*4; x += 4 {
-				cDat[x], cDat[x+2] = cDat[x+2], cDat[x]
+			pix := nRgba.Pix[pixOffset:]
+			switch cgbi.colorType {
+			case ctTrueColorAlpha:
+				// Swap into pix, cDat must stay untouched as it is the
+				// previous row of the next row's filter.
+				for x := 0; x < width*4; x += 4 {
+					pix[x+0], pix[x+1], pix[x+2], pix[x+3] = cDat[x+ri], cDat[x+1], cDat[x+bi], cDat[x+3]
+				}
+				cgbi.unpremultiply(pix[:width*4])
+			case ctTrueColor:
+				for x := 0; x < width; x++ {
+					pix[4*x+0] = cDat[3*x+ri]
+					pix[4*x+1] = cDat[3*x+1]
+					pix[4*x+2] = cDat[3*x+bi]
+					pix[4*x+3] = 0xff
+				}
+			case ctGrayscaleAlpha:
+				for x := 0; x < width; x++ {
+					yCol := cDat[2*x+0]
+					pix[4*x+0], pix[4*x+1], pix[4*x+2], pix[4*x+3] = yCol, yCol, yCol, cDat[2*x+1]
+				}
+				cgbi.unpremultiply(pix[:width*4])
+			default:
+				for x := 0; x < width; x++ {
+					yCol := cDat[x]
+					pix[4*x+0], pix[4*x+1], pix[4*x+2], pix[4*x+3] = yCol, yCol, yCol, 0xff
+				}
 			}
-			copy(nRgba.Pix[pixOffset:], cDat)
 			pixOffset += nRgba.Stride
 		case 16:
-			for x := 0; x < width; x++ {
-				bCol := uint16(cDat[8*x+0])<<8 | uint16(cDat[8*x+1])
-				gCol := uint16(cDat[8*x+2])<<8 | uint16(cDat[8*x+3])
-				rCol := uint16(cDat[8*x+4])<<8 | uint16(cDat[8*x+5])
-				aCol := uint16(cDat[8*x+6])<<8 | uint16(cDat[8*x+7])
-				nRgba64.SetNRGBA64(x, y, color.NRGBA64{rCol, gCol, bCol, aCol})
+			// Like at 8 bits, but with big endian 16-bit samples: the swap
+			// exchanges whole samples, not bytes.
+			sample := func(i int) uint16 { return uint16(cDat[2*i])<<8 | uint16(cDat[2*i+1]) }
+			switch cgbi.colorType {
+			case ctTrueColorAlpha:
+				for x := 0; x < width; x++ {
+					rCol, gCol, bCol, aCol := sample(4*x+ri), sample(4*x+1), sample(4*x+bi), sample(4*x+3)
+					if aCol != 0xffff && aCol != 0 && rCol|gCol|bCol != 0 && cgbi.premultiplied() {
+						cgbi.unpremultiplied = true
+						rCol, gCol, bCol = unpremultiply16(rCol, aCol), unpremultiply16(gCol, aCol), unpremultiply16(bCol, aCol)
+					}
+					nRgba64.SetNRGBA64(x, imgY, color.NRGBA64{rCol, gCol, bCol, aCol})
+				}
+			case ctTrueColor:
+				for x := 0; x < width; x++ {
+					rCol, gCol, bCol := sample(3*x+ri), sample(3*x+1), sample(3*x+bi)
+					nRgba64.SetNRGBA64(x, imgY, color.NRGBA64{rCol, gCol, bCol, 0xffff})
+				}
+			case ctGrayscaleAlpha:
+				for x := 0; x < width; x++ {
+					yCol, aCol := sample(2*x+0), sample(2*x+1)
+					if aCol != 0xffff && aCol != 0 && yCol != 0 && cgbi.premultiplied() {
+						cgbi.unpremultiplied = true
+						yCol = unpremultiply16(yCol, aCol)
+					}
+					nRgba64.SetNRGBA64(x, imgY, color.NRGBA64{yCol, yCol, yCol, aCol})
+				}
+			default:
+				for x := 0; x < width; x++ {
+					yCol := sample(x)
+					nRgba64.SetNRGBA64(x, imgY, color.NRGBA64{yCol, yCol, yCol, 0xffff})
+				}
 			}
 		}
 
+		cgbi.lap(PhaseConvert, &start)
+		if onRow != nil {
+			onRow(y, nrgbaRow(img, row))
+			start = cgbi.clock()
+		}
 		// The current row for y is the previous row for y+1.
 		pr, cr = cr, pr
 	}
 
+	if onRow != nil {
+		return nil, nil
+	}
 	return img, nil
 }
 
+// emitRows passes the rows of img to onRow, like the CgBI decoder does.
+func emitRows(img image.Image, onRow func(y int, row []color.NRGBA)) {
+	b := img.Bounds()
+	row := make([]color.NRGBA, b.Dx())
+	for y := 0; y < b.Dy(); y++ {
+		for x := range row {
+			row[x] = color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+		}
+		onRow(y, row)
+	}
+}
+
+// nrgbaRow returns the colors of the image of a single row img in row,
+// which has its width. 16-bit samples are cut to 8 bits.
+func nrgbaRow(img image.Image, row []color.NRGBA) []color.NRGBA {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		for x := range row {
+			p := img.Pix[4*x : 4*x+4]
+			row[x] = color.NRGBA{p[0], p[1], p[2], p[3]}
+		}
+	case *image.NRGBA64:
+		for x := range row {
+			p := img.Pix[8*x : 8*x+8]
+			row[x] = color.NRGBA{p[0], p[2], p[4], p[6]}
+		}
+	case *image.Paletted:
+		for x := range row {
+			row[x] = color.NRGBA{}
+			if i := int(img.Pix[x]); i < len(img.Palette) {
+				row[x] = color.NRGBAModel.Convert(img.Palette[i]).(color.NRGBA)
+			}
+		}
+	}
+	return row
+}
+
+// unpremultiply turns the premultiplied NRGBA samples in pix into straight
+// alpha, in place, rounding to nearest.
+func (cgbi *IpaPNG) unpremultiply(pix []uint8) {
+	if !cgbi.premultiplied() {
+		return
+	}
+	for i := 0; i < len(pix); i += 4 {
+		a := uint32(pix[i+3])
+		if a == 0xff || a == 0 || pix[i+0]|pix[i+1]|pix[i+2] == 0 {
+			continue
+		}
+		cgbi.unpremultiplied = true
+		for k := i; k < i+3; k++ {
+			c := (uint32(pix[k])*0xff + a/2) / a
+			if c > 0xff {
+				c = 0xff
+			}
+			pix[k] = uint8(c)
+		}
+	}
+}
+
+// cgbiFlagPremultiplied is the bit of the CgBI flags that marks premultiplied
+// colors. It is set in what Xcode writes for RGBA images (0x50002006), while
+// the files seen with it clear (0x50002002) store straight alpha like
+// standard PNG. This is inferred from observed files, Apple doesn't document
+// the flags.
+const cgbiFlagPremultiplied uint32 = 0x4
+
+// cgbiFlagBGR is the bit of the CgBI flags taken to mark samples in blue,
+// green, red order. It is set in both flags Xcode is seen to write
+// (0x50002006 and 0x50002002), so files with it clear are read as RGB(A)
+// instead. Like cgbiFlagPremultiplied this is inferred, not documented, and
+// the samples themselves carry no reliable hint of their order.
+const cgbiFlagBGR uint32 = 0x2
+
+// bgr reports whether the CgBI samples are stored in BGR(A) order. Without
+// flags they are assumed to be.
+func (cgbi *IpaPNG) bgr() bool {
+	return cgbi.IsCgBI && (cgbi.CgBIFlags == 0 || cgbi.CgBIFlags&cgbiFlagBGR != 0)
+}
+
+// ByteOrder returns the order of the color samples in the file: "BGRA" for
+// the usual CgBI files and "RGBA" for standard PNGs and for CgBI files
+// whose flags have the BGR bit (0x2) clear. Img is always in RGBA order;
+// the decoder swaps red and blue only for BGRA files.
+func (cgbi *IpaPNG) ByteOrder() string {
+	if cgbi.bgr() {
+		return "BGRA"
+	}
+	return "RGBA"
+}
+
+// premultiplied reports whether the CgBI colors are premultiplied by alpha.
+// Without flags, as when the CgBI chunk isn't 4 bytes, they are assumed to be.
+func (cgbi *IpaPNG) premultiplied() bool {
+	return cgbi.CgBIFlags == 0 || cgbi.CgBIFlags&cgbiFlagPremultiplied != 0
+}
+
+// unpremultiply16 divides the premultiplied 16-bit sample c by alpha a.
+func unpremultiply16(c, a uint16) uint16 {
+	v := (uint32(c)*0xffff + uint32(a)/2) / uint32(a)
+	if v > 0xffff {
+		v = 0xffff
+	}
+	return uint16(v)
+}
+
 // mergePassInto merges a single pass into a full sized image.
 func (cgbi *IpaPNG) mergePassInto(dst image.Image, src image.Image, pass int) {
 	p := interlacing[pass]
@@ -0,0 +1,683 @@
+package ipaPng
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPassSize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          [7][2]int
+	}{
+		{1, 1, [7][2]int{{1, 1}, {0, 1}, {1, 0}, {0, 1}, {1, 0}, {0, 1}, {1, 0}}},
+		{2, 1, [7][2]int{{1, 1}, {0, 1}, {1, 0}, {0, 1}, {1, 0}, {1, 1}, {2, 0}}},
+		{1, 2, [7][2]int{{1, 1}, {0, 1}, {1, 0}, {0, 1}, {1, 0}, {0, 1}, {1, 1}}},
+		{3, 1, [7][2]int{{1, 1}, {0, 1}, {1, 0}, {1, 1}, {2, 0}, {1, 1}, {3, 0}}},
+		{5, 3, [7][2]int{{1, 1}, {1, 1}, {2, 0}, {1, 1}, {3, 1}, {2, 2}, {5, 1}}},
+		{7, 7, [7][2]int{{1, 1}, {1, 1}, {2, 1}, {2, 2}, {4, 2}, {3, 4}, {7, 3}}},
+		{8, 8, [7][2]int{{1, 1}, {1, 1}, {2, 1}, {2, 2}, {4, 2}, {4, 4}, {8, 4}}},
+		{9, 9, [7][2]int{{2, 2}, {1, 2}, {3, 1}, {2, 3}, {5, 2}, {4, 5}, {9, 4}}},
+		{0, 5, [7][2]int{{0, 1}, {0, 1}, {0, 1}, {0, 2}, {0, 1}, {0, 3}, {0, 2}}},
+	}
+	for _, tt := range tests {
+		for pass, want := range tt.want {
+			w, h := passSize(tt.width, tt.height, pass)
+			if w != want[0] || h != want[1] {
+				t.Errorf("%dx%d pass %d: got %dx%d, want %dx%d", tt.width, tt.height, pass+1, w, h, want[0], want[1])
+			}
+		}
+	}
+}
+
+func TestDecodeTinyInterlaced(t *testing.T) {
+	for _, size := range [][2]int{{1, 1}, {2, 1}, {1, 2}, {3, 1}, {5, 3}} {
+		img := testImage(size[0], size[1])
+		cgbi := decodeBytes(t, makeCgBI(img, true), DecodeOptions{})
+		sameImage(t, cgbi.Img, img)
+	}
+}
+
+// physData returns a pHYs payload.
+func physData(x, y uint32, unit byte) []byte {
+	d := make([]byte, 9)
+	binary.BigEndian.PutUint32(d[0:], x)
+	binary.BigEndian.PutUint32(d[4:], y)
+	d[8] = unit
+	return d
+}
+
+func TestDPI(t *testing.T) {
+	img := testImage(2, 2)
+	// 3780 pixels per meter are 96.012 dpi, 11811 are 299.9994.
+	phys := testChunk{"pHYs", physData(3780, 11811, 1)}
+	cgbi := decodeBytes(t, makeCgBI(img, false, phys), DecodeOptions{})
+	x, y, ok := cgbi.DPI()
+	if !ok || math.Abs(x-96.012) > 1e-9 || math.Abs(y-299.9994) > 1e-9 {
+		t.Errorf("DPI() = %v, %v, %v", x, y, ok)
+	}
+
+	// The chunk survives re-encoding.
+	var b bytes.Buffer
+	if err := cgbi.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := decodeBytes(t, b.Bytes(), DecodeOptions{})
+	if x2, y2, ok := out.DPI(); !ok || x2 != x || y2 != y {
+		t.Errorf("DPI() after Encode = %v, %v, %v", x2, y2, ok)
+	}
+
+	// Without a unit, or without pHYs, there is no DPI.
+	for _, extra := range [][]testChunk{{{"pHYs", physData(1, 1, 0)}}, nil} {
+		if _, _, ok := decodeBytes(t, makeCgBI(img, false, extra...), DecodeOptions{}).DPI(); ok {
+			t.Errorf("DPI() ok with %v", extra)
+		}
+	}
+}
+
+func BenchmarkDecodeGray1Wide(b *testing.B) {
+	const width, height = 4096, 256
+	var raw []byte
+	for y := 0; y < height; y++ {
+		raw = append(raw, ftNone)
+		for x := 0; x < width/8; x++ {
+			raw = append(raw, uint8(x*31+y))
+		}
+	}
+	f := makeFile(width, height, 1, ctGrayscale, 0, raw, true)
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes.NewReader(f)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeRGBA decodes premultiplied colors, so it includes undoing
+// the premultiplication.
+func BenchmarkDecodeRGBA(b *testing.B) {
+	img := testImage(512, 512)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = uint8(i)
+	}
+	f := makeFile(512, 512, 8, ctTrueColorAlpha, 0, cgbiRows(img, false), true)
+	b.SetBytes(int64(len(img.Pix)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes.NewReader(f)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestForceColorType(t *testing.T) {
+	img := testImage(4, 1)
+	// IHDR claims 8-bit grayscale, but the rows hold RGBA.
+	f := makeFile(4, 1, 8, ctGrayscale, 0, cgbiRows(img, false), true)
+	if cgbi := decodeBytes(t, f, DecodeOptions{}); cgbi.HasAlpha() {
+		t.Error("IHDR color type not used without ForceColorType")
+	}
+	rgba, depth := ctTrueColorAlpha, 8
+	cgbi := decodeBytes(t, f, DecodeOptions{ForceColorType: &rgba, ForceDepth: &depth})
+	sameImage(t, cgbi.Img, img)
+
+	// The forced values are validated like IHDR ones.
+	bad := 4
+	if _, err := DecodeWithOptions(bytes.NewReader(f), DecodeOptions{ForceColorType: &rgba, ForceDepth: &bad}); err == nil {
+		t.Error("RGBA at depth 4 accepted")
+	}
+}
+
+func TestDecodeBrokenTail(t *testing.T) {
+	img := testImage(5, 4)
+	raw := cgbiRows(img, false)
+	ihdr := testChunk{dsSeenIHDR, ihdrData(5, 4, 8, ctTrueColorAlpha, 0)}
+	build := func(idat []byte) []byte {
+		return buildPNG(cgbiChunk, ihdr, testChunk{dsSeenIDAT, idat}, testChunk{dsSeenIEND, nil})
+	}
+
+	// Every row is there, but the stream lacks its final block, which
+	// makes the inflater report io.ErrUnexpectedEOF right after them.
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.BestCompression)
+	w.Write(raw)
+	w.Flush()
+	sameImage(t, decodeBytes(t, build(b.Bytes()), DecodeOptions{}).Img, img)
+	if _, err := DecodeWithOptions(bytes.NewReader(build(b.Bytes())), DecodeOptions{VerifyChecksum: true}); err == nil {
+		t.Error("VerifyChecksum accepted a stream without its final block")
+	}
+
+	// A complete stream followed by padding.
+	padded := append(compress(raw, true), 0, 0, 0, 0xff)
+	sameImage(t, decodeBytes(t, build(padded), DecodeOptions{}).Img, img)
+
+	// A stream that ends inside the last row is still an error.
+	b.Reset()
+	w.Reset(&b)
+	w.Write(raw[:len(raw)-3])
+	w.Flush()
+	_, err := Decode(bytes.NewReader(build(b.Bytes())))
+	var dim *DimensionError
+	if !errors.As(err, &dim) {
+		t.Errorf("got %v, want a DimensionError", err)
+	}
+}
+
+func TestDuplicateCgBIChunk(t *testing.T) {
+	img := testImage(3, 3)
+	chunks := splitPNG(makeCgBI(img, false))
+	// The duplicate claims straight alpha, which must not count.
+	dup := testChunk{dsSeenCgBI, []byte{0x50, 0x00, 0x20, 0x02}}
+	for idx := 1; idx <= 2; idx++ {
+		f := append(append(append([]testChunk{}, chunks[:idx]...), dup), chunks[idx:]...)
+		cgbi := decodeBytes(t, buildPNG(f...), DecodeOptions{})
+		if cgbi.CgBIFlags != 0x50002006 {
+			t.Errorf("duplicate at #%d: CgBIFlags %#x, want those of the first chunk", idx, cgbi.CgBIFlags)
+		}
+		sameImage(t, cgbi.Img, img)
+		want := fmt.Sprintf("ignoring duplicate CgBI chunk #%d", idx)
+		if w := cgbi.Warnings(); len(w) != 1 || w[0] != want {
+			t.Errorf("warnings %q, want %q", w, want)
+		}
+	}
+}
+
+func TestParseIHDRShortData(t *testing.T) {
+	for _, n := range []int{0, 5, 12} {
+		c := &Chunk{Length: iHDRLength, CType: dsSeenIHDR, Data: ihdrData(1, 1, 8, ctTrueColorAlpha, 0)[:n]}
+		err := (&IpaPNG{}).parseIHDR(c)
+		want := fmt.Sprintf("invalid IHDR data: got %d bytes - expected 13", n)
+		if err == nil || err.Error() != want {
+			t.Errorf("%d bytes: got %v, want %q", n, err, want)
+		}
+	}
+}
+
+func TestDecodeZeroLengthIDAT(t *testing.T) {
+	img := testImage(13, 9)
+	chunks := splitPNG(makeCgBI(img, false))
+	// CgBI, IHDR, IDAT, IEND: cut the IDAT in two, with empty ones around.
+	data := chunks[2].data
+	empty := testChunk{dsSeenIDAT, nil}
+	f := buildPNG(chunks[0], chunks[1], empty,
+		testChunk{dsSeenIDAT, data[:len(data)/2]}, empty,
+		testChunk{dsSeenIDAT, data[len(data)/2:]}, empty, chunks[3])
+	cgbi := decodeBytes(t, f, DecodeOptions{})
+	sameImage(t, cgbi.Img, img)
+	for _, v := range CheckSpec(bytes.NewReader(f)) {
+		if strings.Contains(v, "IDAT") {
+			t.Errorf("CheckSpec: %v", v)
+		}
+	}
+
+	// Only empty IDAT chunks leave nothing to decode.
+	f = buildPNG(chunks[0], chunks[1], empty, empty, chunks[3])
+	if _, err := Decode(bytes.NewReader(f)); err == nil || !strings.Contains(err.Error(), "all IDAT chunks are empty") {
+		t.Errorf("got %v for empty IDAT chunks only", err)
+	}
+}
+
+func TestDecodeGzip(t *testing.T) {
+	img := testImage(6, 5)
+	f := makeCgBI(img, false)
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(f)
+	zw.Close()
+	cgbi := decodeBytes(t, b.Bytes(), DecodeOptions{})
+	if !cgbi.IsCgBI {
+		t.Error("gzipped CgBI file not detected as CgBI")
+	}
+	sameImage(t, cgbi.Img, img)
+
+	// A broken gzip stream is an error, not a PNG signature mismatch.
+	if _, err := Decode(bytes.NewReader(b.Bytes()[:b.Len()/2])); err == nil {
+		t.Error("truncated gzip stream accepted")
+	}
+}
+
+func TestDecodeWrongHeight(t *testing.T) {
+	img := testImage(4, 3)
+	// IHDR claims 5 rows, IDAT holds 3.
+	f := makeFile(4, 5, 8, ctTrueColorAlpha, 0, cgbiRows(img, false), true)
+	_, err := Decode(bytes.NewReader(f))
+	var dim *DimensionError
+	if !errors.As(err, &dim) {
+		t.Fatalf("got %v, want a DimensionError", err)
+	}
+	want := DimensionError{Width: 4, Height: 5, Expected: 5 * 17, Available: 3 * 17, InferredHeight: 3}
+	if *dim != want {
+		t.Errorf("got %+v, want %+v", *dim, want)
+	}
+	msg := "not enough pixel data: IHDR declares 4x5, which needs 85 bytes, but IDAT holds 51, enough for a height of 3"
+	if !strings.Contains(err.Error(), msg) {
+		t.Errorf("error %q, want %q", err, msg)
+	}
+
+	cgbi := decodeBytes(t, f, DecodeOptions{InferHeight: true})
+	sameImage(t, cgbi.Img, img)
+	if cgbi.Height() != 3 {
+		t.Errorf("Height() = %d, want 3", cgbi.Height())
+	}
+	if w := cgbi.Warnings(); len(w) != 1 || w[0] != "IHDR declares a height of 5 but IDAT only holds 3 rows" {
+		t.Errorf("warnings %q", w)
+	}
+}
+
+func TestDecode16BitAverage(t *testing.T) {
+	const w, h = 4, 3
+	want := image.NewNRGBA64(image.Rect(0, 0, w, h))
+	var raw []byte
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// Low bytes near 0xff, so averaging them carries.
+			c := color.NRGBA64{uint16(0x10ff + x*0x1f01), uint16(0xfffe - y*0x2101), uint16(0x80ff + x*y*0x0f01), 0xffff}
+			want.SetNRGBA64(x, y, c)
+			raw = append(raw, byte(c.B>>8), byte(c.B), byte(c.G>>8), byte(c.G), byte(c.R>>8), byte(c.R))
+		}
+	}
+	f := makeFile(w, h, 16, ctTrueColor, 0, filterRows(raw, w*6, 6, ftAverage), true)
+	got := decodeBytes(t, f, DecodeOptions{}).Img
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if c := color.NRGBA64Model.Convert(got.At(x, y)); c != want.NRGBA64At(x, y) {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, c, want.NRGBA64At(x, y))
+			}
+		}
+	}
+}
+
+// BenchmarkDecodeInterlaced reports the allocations of an Adam7 decode, whose
+// passes share their row buffers.
+func BenchmarkDecodeInterlaced(b *testing.B) {
+	img := testImage(512, 512)
+	f := makeCgBI(img, true)
+	b.SetBytes(int64(len(img.Pix)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes.NewReader(f)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestForceInterlace(t *testing.T) {
+	img := testImage(9, 7)
+	// Adam7 rows under an IHDR that claims sequential ones, and the reverse.
+	for _, interlace := range []int{1, 0} {
+		f := makeFile(9, 7, 8, ctTrueColorAlpha, 1-interlace, cgbiRows(img, interlace == 1), true)
+		if cgbi, err := Decode(bytes.NewReader(f)); err == nil && cgbi.Img != nil {
+			// The data may happen to fit, but not as the right image.
+			var diff bool
+			for i := 0; i < 9*7 && !diff; i++ {
+				diff = color.NRGBAModel.Convert(cgbi.Img.At(i%9, i/9)) != img.NRGBAAt(i%9, i/9)
+			}
+			if !diff {
+				t.Errorf("interlace %d: decoded right without ForceInterlace", interlace)
+			}
+		}
+		il := interlace
+		sameImage(t, decodeBytes(t, f, DecodeOptions{ForceInterlace: &il}).Img, img)
+	}
+	bad := 2
+	f := makeCgBI(img, false)
+	if _, err := DecodeWithOptions(bytes.NewReader(f), DecodeOptions{ForceInterlace: &bad}); err == nil {
+		t.Error("interlace method 2 accepted")
+	}
+}
+
+func TestStrictRowCount(t *testing.T) {
+	img := testImage(4, 5)
+	// IHDR claims 3 rows, IDAT holds 5.
+	f := makeFile(4, 3, 8, ctTrueColorAlpha, 0, cgbiRows(img, false), true)
+	sameImage(t, decodeBytes(t, f, DecodeOptions{}).Img, img.SubImage(image.Rect(0, 0, 4, 3)).(*image.NRGBA))
+
+	_, err := DecodeWithOptions(bytes.NewReader(f), DecodeOptions{StrictRowCount: true})
+	var dim *DimensionError
+	if !errors.As(err, &dim) {
+		t.Fatalf("got %v, want a DimensionError", err)
+	}
+	if want := (DimensionError{Width: 4, Height: 3, Expected: 3 * 17, Available: 5 * 17, InferredHeight: 5}); *dim != want {
+		t.Errorf("got %+v, want %+v", *dim, want)
+	}
+	if !strings.HasPrefix(dim.Error(), "too much pixel data") {
+		t.Errorf("error %q", dim)
+	}
+
+	// MaxRows leaves rows unread on purpose.
+	if _, err := DecodeWithOptions(bytes.NewReader(f), DecodeOptions{StrictRowCount: true, MaxRows: 2}); err != nil {
+		t.Errorf("MaxRows 2: %v", err)
+	}
+	// The exact row count passes.
+	decodeBytes(t, makeCgBI(img, false), DecodeOptions{StrictRowCount: true})
+}
+
+func TestDecodeEmptyInput(t *testing.T) {
+	_, err := Decode(bytes.NewReader(nil))
+	if !errors.Is(err, ErrEmptyInput) {
+		t.Errorf("got %v, want ErrEmptyInput", err)
+	}
+	var se *StageError
+	if !errors.As(err, &se) || se.Stage != StageSignature {
+		t.Errorf("got %#v, want a StageError at %v", err, StageSignature)
+	}
+
+	_, err = Decode(bytes.NewReader([]byte(pngHeader[:3])))
+	if errors.Is(err, ErrEmptyInput) {
+		t.Error("truncated signature reported as ErrEmptyInput")
+	}
+	if want := "truncated PNG signature, only 3 of 8 bytes"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+// flaggedCgBI builds a CgBI file of img with the given CgBI flags, storing
+// the samples the way the flags say.
+func flaggedCgBI(img *image.NRGBA, flags uint32) []byte {
+	var raw []byte
+	b := img.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		raw = append(raw, ftNone)
+		for x := 0; x < b.Dx(); x++ {
+			c := img.NRGBAAt(x, y)
+			if flags&cgbiFlagPremultiplied != 0 {
+				c.R = uint8((int(c.R)*int(c.A) + 127) / 255)
+				c.G = uint8((int(c.G)*int(c.A) + 127) / 255)
+				c.B = uint8((int(c.B)*int(c.A) + 127) / 255)
+			}
+			if flags&cgbiFlagBGR != 0 {
+				c.R, c.B = c.B, c.R
+			}
+			raw = append(raw, c.R, c.G, c.B, c.A)
+		}
+	}
+	chunks := splitPNG(makeFile(b.Dx(), b.Dy(), 8, ctTrueColorAlpha, 0, raw, true))
+	binary.BigEndian.PutUint32(chunks[0].data, flags)
+	return buildPNG(chunks...)
+}
+
+func TestCgBIFlagsPremultiplied(t *testing.T) {
+	// Multiples of 3 at an alpha of 0x55 premultiply without rounding.
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0x30, 0x60, 0x90, 0x55})
+	img.SetNRGBA(1, 0, color.NRGBA{0x33, 0x66, 0x99, 0xff})
+	for _, flags := range []uint32{0x50002006, 0x50002002} {
+		cgbi := decodeBytes(t, flaggedCgBI(img, flags), DecodeOptions{})
+		if cgbi.CgBIFlags != flags {
+			t.Errorf("CgBIFlags %#x, want %#x", cgbi.CgBIFlags, flags)
+		}
+		sameImage(t, cgbi.Img, img)
+	}
+	// Straight samples read as premultiplied come out too bright.
+	chunks := splitPNG(flaggedCgBI(img, 0x50002002))
+	binary.BigEndian.PutUint32(chunks[0].data, 0x50002006)
+	if got := decodeBytes(t, buildPNG(chunks...), DecodeOptions{}).Img.At(0, 0); got == img.At(0, 0) {
+		t.Error("premultiplied flag ignored")
+	}
+}
+
+func TestDecodeGray4Filters(t *testing.T) {
+	const w, h = 7, 4
+	want := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rowLen := (w + 1) / 2
+	raw := make([]byte, rowLen*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*5 + y*3) % 16)
+			raw[y*rowLen+x/2] |= v << uint(4-4*(x%2))
+			want.SetNRGBA(x, y, color.NRGBA{v * 0x11, v * 0x11, v * 0x11, 0xff})
+		}
+	}
+	for _, ft := range []byte{ftSub, ftAverage, ftPaeth} {
+		// One byte back stands in for the pixel to the left.
+		f := makeFile(w, h, 4, ctGrayscale, 0, filterRows(raw, rowLen, 1, ft), true)
+		cgbi, err := Decode(bytes.NewReader(f))
+		if err != nil {
+			t.Fatalf("filter %d: %v", ft, err)
+		}
+		sameImage(t, cgbi.Img, want)
+	}
+}
+
+func TestDecode16BitColorTypes(t *testing.T) {
+	const w, h = 3, 2
+	for _, ct := range []int{ctTrueColor, ctGrayscale, ctGrayscaleAlpha} {
+		want := image.NewNRGBA64(image.Rect(0, 0, w, h))
+		var raw []byte
+		put := func(v uint16) { raw = append(raw, byte(v>>8), byte(v)) }
+		for y := 0; y < h; y++ {
+			raw = append(raw, ftNone)
+			for x := 0; x < w; x++ {
+				v := uint16(0x0102 + x*0x3344 + y*0x1011)
+				c := color.NRGBA64{v, v, v, 0xffff}
+				switch ct {
+				case ctTrueColor:
+					c.R, c.B = v^0xff00, v^0x00ff
+					put(c.B)
+					put(c.G)
+					put(c.R)
+				case ctGrayscale:
+					put(v)
+				case ctGrayscaleAlpha:
+					put(v)
+					put(0xffff)
+				}
+				want.SetNRGBA64(x, y, c)
+			}
+		}
+		cgbi := decodeBytes(t, makeFile(w, h, 16, ct, 0, raw, true), DecodeOptions{})
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				if c := color.NRGBA64Model.Convert(cgbi.Img.At(x, y)); c != want.NRGBA64At(x, y) {
+					t.Errorf("color type %d: pixel %d,%d is %v, want %v", ct, x, y, c, want.NRGBA64At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestChunkOrderError(t *testing.T) {
+	chunks := splitPNG(makeCgBI(testImage(2, 2), false))
+	cgbiC, ihdr, idat, iend := chunks[0], chunks[1], chunks[2], chunks[3]
+	tests := []struct {
+		chunks []testChunk
+		want   string
+	}{
+		{[]testChunk{cgbiC, idat, ihdr, iend}, "chunk out of order: IDAT before IHDR (chunk #1)"},
+		{[]testChunk{cgbiC, ihdr, ihdr, idat, iend}, "chunk out of order: duplicate IHDR (chunk #2)"},
+		{[]testChunk{cgbiC, ihdr, iend}, "chunk out of order: IEND before IDAT (chunk #2)"},
+		{[]testChunk{cgbiC, ihdr, idat, {"PLTE", []byte{0, 0, 0}}, iend}, "chunk out of order: PLTE after IDAT (chunk #3)"},
+	}
+	for _, tt := range tests {
+		_, err := Decode(bytes.NewReader(buildPNG(tt.chunks...)))
+		var oe *ChunkOrderError
+		if !errors.As(err, &oe) || err.Error() != tt.want {
+			t.Errorf("got %v, want %q", err, tt.want)
+		}
+	}
+}
+
+func TestOnRow(t *testing.T) {
+	img := testImage(6, 5)
+	var want [4]int
+	for i, v := range img.Pix {
+		want[i%4] += int(v)
+	}
+	var std bytes.Buffer
+	if err := png.Encode(&std, img); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range [][]byte{makeCgBI(img, false), std.Bytes()} {
+		var sum [4]int
+		next := 0
+		cgbi := decodeBytes(t, f, DecodeOptions{OnRow: func(y int, row []color.NRGBA) {
+			if y != next || len(row) != 6 {
+				t.Errorf("row %d of %d pixels, want row %d of 6", y, len(row), next)
+			}
+			next++
+			for _, c := range row {
+				sum[0], sum[1], sum[2], sum[3] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B), sum[3]+int(c.A)
+			}
+		}})
+		if next != 5 || sum != want {
+			t.Errorf("CgBI %v: %d rows summing to %v, want 5 summing to %v", cgbi.IsCgBI, next, sum, want)
+		}
+		if cgbi.Img != nil {
+			t.Errorf("CgBI %v: Img kept", cgbi.IsCgBI)
+		}
+	}
+
+	onRow := func(int, []color.NRGBA) {}
+	if _, err := DecodeWithOptions(bytes.NewReader(makeCgBI(img, true)), DecodeOptions{OnRow: onRow}); err == nil {
+		t.Error("OnRow accepted an interlaced file")
+	}
+}
+
+func TestDecodeMalformedStandardPNG(t *testing.T) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, testImage(4, 4)); err != nil {
+		t.Fatal(err)
+	}
+	chunks := splitPNG(b.Bytes())
+	// An unknown filter type in the first row.
+	raw := make([]byte, 4*(1+4*4))
+	raw[0] = 9
+	for i, c := range chunks {
+		if c.cType == dsSeenIDAT {
+			chunks[i].data = compress(raw, false)
+		}
+	}
+	_, err := Decode(bytes.NewReader(buildPNG(chunks...)))
+	const prefix = "input is not CgBI and image/png failed to decode it: "
+	if err == nil || !strings.HasPrefix(err.Error(), prefix) {
+		t.Fatalf("got %v, want it to start with %q", err, prefix)
+	}
+	var fe png.FormatError
+	if !errors.As(err, &fe) {
+		t.Errorf("no png.FormatError in %v", err)
+	}
+	var se *StageError
+	if !errors.As(err, &se) || se.Stage != StagePNG {
+		t.Errorf("stage of %v, want %v", err, StagePNG)
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+	img := testImage(3, 2)
+	tests := []struct {
+		flags uint32
+		want  string
+	}{
+		{0x50002006, "BGRA"},
+		{0x50002002, "BGRA"},
+		{0x50002004, "RGBA"},
+		{0x50002000, "RGBA"},
+	}
+	for _, tt := range tests {
+		cgbi := decodeBytes(t, flaggedCgBI(img, tt.flags), DecodeOptions{})
+		if got := cgbi.ByteOrder(); got != tt.want {
+			t.Errorf("flags %#x: ByteOrder() = %v, want %v", tt.flags, got, tt.want)
+		}
+		// Img is RGBA either way.
+		sameImage(t, cgbi.Img, img)
+	}
+	var std bytes.Buffer
+	png.Encode(&std, img)
+	if got := decodeBytes(t, std.Bytes(), DecodeOptions{}).ByteOrder(); got != "RGBA" {
+		t.Errorf("standard PNG: ByteOrder() = %v", got)
+	}
+}
+
+func TestPassLengthLarge(t *testing.T) {
+	const maxInt = int(^uint(0) >> 1)
+	for _, p := range interlacing {
+		// The exact ceil((maxInt-offset)/factor), without overflowing.
+		want := (maxInt - p.xOffset) / p.xFactor
+		if (maxInt-p.xOffset)%p.xFactor != 0 {
+			want++
+		}
+		if n := passLength(maxInt, p.xOffset, p.xFactor); n != want {
+			t.Errorf("offset %d factor %d: got %d, want %d", p.xOffset, p.xFactor, n, want)
+		}
+	}
+}
+
+// TestDecodeCorruptIHDR runs the seeds a fuzzer starts from: IHDR values
+// that must give an error, not a panic or a huge allocation.
+func TestDecodeCorruptIHDR(t *testing.T) {
+	raw := cgbiRows(testImage(2, 2), false)
+	tests := []struct {
+		width, height    uint32
+		depth, colorType int
+		interlace        int
+	}{
+		{0, 2, 8, ctTrueColorAlpha, 0},
+		{2, 0, 8, ctTrueColorAlpha, 1},
+		{1<<31 - 1, 2, 8, ctTrueColorAlpha, 0},
+		{2, 1<<31 - 1, 8, ctTrueColorAlpha, 1},
+		{1<<31 - 1, 1<<31 - 1, 8, ctTrueColorAlpha, 1},
+		{1 << 31, 2, 8, ctTrueColorAlpha, 0},
+		{1<<32 - 1, 1<<32 - 1, 1, ctGrayscale, 1},
+		{2, 2, 3, ctTrueColorAlpha, 0},
+		{2, 2, 8, 5, 0},
+		{2, 2, 8, ctTrueColorAlpha, 2},
+	}
+	for _, tt := range tests {
+		ihdr := ihdrData(0, 0, tt.depth, tt.colorType, tt.interlace)
+		binary.BigEndian.PutUint32(ihdr[0:], tt.width)
+		binary.BigEndian.PutUint32(ihdr[4:], tt.height)
+		f := buildPNG(cgbiChunk, testChunk{dsSeenIHDR, ihdr}, testChunk{dsSeenIDAT, compress(raw, true)}, testChunk{dsSeenIEND, nil})
+		if _, err := Decode(bytes.NewReader(f)); err == nil {
+			t.Errorf("%+v accepted", tt)
+		}
+	}
+}
+
+func TestParseIHDRErrors(t *testing.T) {
+	raw := compress(cgbiRows(testImage(1, 1), false), true)
+	build := func(ihdr []byte) []byte {
+		return buildPNG(cgbiChunk, testChunk{dsSeenIHDR, ihdr}, testChunk{dsSeenIDAT, raw}, testChunk{dsSeenIEND, nil})
+	}
+	if _, err := Decode(bytes.NewReader(build(nil))); err == nil || err.Error() != "invalid IHDR length: got 0 - expected 13" {
+		t.Errorf("empty IHDR: got %v", err)
+	}
+	for _, tt := range [][2]int{{2, 4}, {6, 1}, {3, 16}, {0, 3}, {4, 2}, {7, 8}} {
+		_, err := Decode(bytes.NewReader(build(ihdrData(1, 1, tt[1], tt[0], 0))))
+		want := fmt.Sprintf("invalid bit depth %d for color type %d", tt[1], tt[0])
+		if err == nil || err.Error() != want {
+			t.Errorf("got %v, want %q", err, want)
+		}
+	}
+}
+
+func TestPaletteIndexOutOfRange(t *testing.T) {
+	plte := testChunk{"PLTE", []byte{0xff, 0, 0, 0, 0xff, 0, 0, 0, 0xff}}
+	raw := []byte{ftNone, 0, 1, 2, 3, 9}
+	f := makeFile(5, 1, 8, ctPaletted, 0, raw, true, plte)
+	_, err := Decode(bytes.NewReader(f))
+	if want := "palette index 3 out of range: PLTE has 3 entries"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+
+	cgbi := decodeBytes(t, f, DecodeOptions{ClampPaletteIndex: true})
+	if got, want := cgbi.Img.(*image.Paletted).Pix, []uint8{0, 1, 2, 2, 2}; !bytes.Equal(got, want) {
+		t.Errorf("indices %v, want %v", got, want)
+	}
+	if w := cgbi.Warnings(); len(w) != 1 || w[0] != "clamped palette indices past the 3 PLTE entries to the last one" {
+		t.Errorf("warnings %q", w)
+	}
+}
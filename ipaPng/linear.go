@@ -0,0 +1,63 @@
+package ipaPng
+
+import (
+	"image"
+	"math"
+)
+
+// srgbToLinear applies the inverse sRGB transfer function of IEC 61966-2-1
+// to a sample in [0,1].
+func srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// srgbLUT maps 8-bit sRGB samples to linear values.
+var srgbLUT = func() (lut [256]float32) {
+	for i := range lut {
+		lut[i] = float32(srgbToLinear(float64(i) / 255))
+	}
+	return lut
+}()
+
+// DecodeLinear returns the decoded image as linear-light RGBA float32
+// samples in [0,1], four per pixel in row order, along with the width and
+// height. The color samples are assumed to be sRGB encoded and are
+// linearized with the IEC 61966-2-1 transfer function; alpha is already
+// linear and left as is. Like the decoded image, the result has straight
+// alpha, also for CgBI files.
+func (cgbi *IpaPNG) DecodeLinear() ([]float32, int, int) {
+	if cgbi.Img == nil {
+		return nil, 0, 0
+	}
+	b := cgbi.Img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := make([]float32, 0, w*h*4)
+
+	if nRgba64, ok := cgbi.Img.(*image.NRGBA64); ok {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := nRgba64.NRGBA64At(b.Min.X+x, b.Min.Y+y)
+				for _, v := range [3]uint16{c.R, c.G, c.B} {
+					out = append(out, float32(srgbToLinear(float64(v)/0xffff)))
+				}
+				out = append(out, float32(c.A)/0xffff)
+			}
+		}
+		return out, w, h
+	}
+
+	nRgba := toNRGBA(cgbi.Img)
+	for y := 0; y < h; y++ {
+		pix := nRgba.Pix[y*nRgba.Stride : y*nRgba.Stride+w*4]
+		for x := 0; x < len(pix); x += 4 {
+			for _, v := range pix[x : x+3] {
+				out = append(out, srgbLUT[v])
+			}
+			out = append(out, float32(pix[x+3])/255)
+		}
+	}
+	return out, w, h
+}
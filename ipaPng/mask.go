@@ -0,0 +1,51 @@
+package ipaPng
+
+import (
+	"image"
+	"image/color"
+)
+
+// AlphaMask returns the straight alpha channel of the decoded image as a
+// grayscale image: opaque pixels are white, transparent ones black.
+func (cgbi *IpaPNG) AlphaMask() *image.Gray {
+	if cgbi.Img == nil {
+		return nil
+	}
+	b := cgbi.Img.Bounds()
+	mask := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if nRgba, ok := cgbi.Img.(*image.NRGBA); ok {
+		for y := 0; y < b.Dy(); y++ {
+			src := nRgba.Pix[y*nRgba.Stride:]
+			dst := mask.Pix[y*mask.Stride : y*mask.Stride+b.Dx()]
+			for x := range dst {
+				dst[x] = src[4*x+3]
+			}
+		}
+		return mask
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			_, _, _, a := cgbi.Img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			mask.Pix[y*mask.Stride+x] = uint8(a >> 8)
+		}
+	}
+	return mask
+}
+
+// ThresholdMask returns the alpha channel of the decoded image as a 1-bit
+// stencil: pixels whose straight alpha is at least t are white, the others
+// black. 16-bit alpha is cut to 8 bits before the comparison. Encoded with
+// image/png the mask is written with 1 bit per pixel.
+func (cgbi *IpaPNG) ThresholdMask(t uint8) *image.Paletted {
+	alpha := cgbi.AlphaMask()
+	if alpha == nil {
+		return nil
+	}
+	mask := image.NewPaletted(alpha.Rect, color.Palette{color.Black, color.White})
+	for i, a := range alpha.Pix {
+		if a >= t {
+			mask.Pix[i] = 1
+		}
+	}
+	return mask
+}
@@ -0,0 +1,46 @@
+package ipaPng
+
+import "fmt"
+
+// Metadata sums up a decoded file for asset catalogs and build tools. It
+// marshals to JSON with the field names in lower camel case, as in
+// {"width":180,"height":180,...}.
+type Metadata struct {
+	Width           int         `json:"width"`  // of Img, so after any edits
+	Height          int         `json:"height"` // of Img, so after any edits
+	ColorType       int         `json:"colorType"`
+	Depth           int         `json:"depth"`
+	HasAlpha        bool        `json:"hasAlpha"`
+	DPI             *Resolution `json:"dpi,omitempty"` // nil without a pHYs chunk in meters
+	AverageColor    string      `json:"averageColor"`  // #rrggbbaa, see AverageColor
+	IsCgBI          bool        `json:"isCgBI"`
+	Unpremultiplied bool        `json:"unpremultiplied"` // see Unpremultiplied
+}
+
+// Resolution is a physical resolution in dots per inch.
+type Resolution struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Metadata returns the Metadata of the decoded file. The header fields are
+// those of the file, the size and the average color those of Img.
+func (cgbi *IpaPNG) Metadata() Metadata {
+	m := Metadata{
+		ColorType:       cgbi.colorType,
+		Depth:           cgbi.depth,
+		HasAlpha:        cgbi.HasAlpha(),
+		IsCgBI:          cgbi.IsCgBI,
+		Unpremultiplied: cgbi.unpremultiplied,
+	}
+	if cgbi.Img != nil {
+		b := cgbi.Img.Bounds()
+		m.Width, m.Height = b.Dx(), b.Dy()
+	}
+	if x, y, ok := cgbi.DPI(); ok {
+		m.DPI = &Resolution{X: x, Y: y}
+	}
+	c := cgbi.AverageColor()
+	m.AverageColor = fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+	return m
+}
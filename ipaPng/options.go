@@ -0,0 +1,113 @@
+package ipaPng
+
+import "image/color"
+
+// DecodeOptions tunes how a CgBI file is decoded. The zero value gives the
+// same result as Decode. Standard PNG files are handed to image/png, so only
+// the chunk level options (BufferPool, ChunkRewriter, SkipIDAT, IgnoreCRC)
+// and OnRow apply to them.
+type DecodeOptions struct {
+	// ForceColorType and ForceDepth override the color type and bit depth
+	// read from IHDR, e.g. to read mislabeled data as RGBA8. The combination
+	// is still validated like IHDR values are. This is an expert recovery
+	// tool: if the guess is wrong the decoded image is garbage.
+	ForceColorType *int
+	ForceDepth     *int
+
+	// ForceInterlace overrides the interlace method read from IHDR, 0 for
+	// sequential rows or 1 for Adam7; other values are rejected. It is
+	// another expert recovery tool, for files whose interlace byte is wrong.
+	ForceInterlace *int
+
+	// MaxRows, when positive, stops decoding after that many rows and
+	// returns the image cropped to them, which is cheap for previews of tall
+	// images. Adam7 spreads every row over all passes, so interlaced files
+	// can't be decoded partially and make Decode fail when MaxRows is set.
+	MaxRows int
+
+	// OnRow, when set, is called with every row as soon as it is decoded,
+	// top to bottom, so huge images can be processed with the memory of a
+	// single row: the full image is not kept and Img stays nil. row holds
+	// the colors with straight alpha, 16-bit samples cut to 8 bits, and is
+	// reused for the next row. MaxRows and InferHeight still apply. Adam7
+	// spreads every row over all passes, so interlaced files make Decode
+	// fail when OnRow is set. Standard PNG files are decoded whole by
+	// image/png and then passed on row by row.
+	OnRow func(y int, row []color.NRGBA)
+
+	// Instrument, when set, times the decoding phases for Timings. Without
+	// it the clock is never read.
+	Instrument bool
+
+	// BufferPool, when set, provides the chunk data buffers. See BufferPool
+	// for when they may be used.
+	BufferPool *BufferPool
+
+	// InferHeight, when set, turns a non-interlaced image whose IDAT data
+	// runs out early into an image of the rows that are there, with a
+	// warning, instead of failing with a DimensionError.
+	InferHeight bool
+
+	// StrictRowCount, when set, makes Decode fail with a DimensionError if
+	// IDAT holds more data than the rows declared in IHDR need. By default
+	// the rest is ignored. It has no effect when MaxRows cuts the image short.
+	StrictRowCount bool
+
+	// ClampPaletteIndex, when set, reads palette indices past the end of a
+	// short PLTE, e.g. index 120 with 100 entries, as the last entry, with a
+	// warning. By default they make Decode fail, as the PNG spec has it.
+	ClampPaletteIndex bool
+
+	// VerifyChecksum, when set, inflates the whole IDAT stream once more
+	// after decoding and makes Decode fail with a ChecksumError if it is
+	// broken or doesn't match the Adler-32 checksum stored after it. That
+	// catches corrupt data that still happened to fill every row. CgBI
+	// streams often have no checksum at all, which is only a warning, and
+	// by default nothing past the last row is looked at.
+	VerifyChecksum bool
+
+	// ChunkRewriter, when set, is called with every chunk right after it was
+	// read and may change it, e.g. blank out a corrupt tEXt. By default it
+	// runs after the CRC check, so it only sees intact chunks, and its
+	// changes need no valid CRC. With RewriteBeforeCRC it runs before the
+	// check instead, which then applies to the rewritten chunk: a rewriter
+	// can repair a chunk by fixing its Data or Crc32, and Position is not
+	// set yet. Standard PNG files are decoded from the rewritten chunks.
+	ChunkRewriter    func(*Chunk)
+	RewriteBeforeCRC bool
+
+	// SkipIDAT, when set, seeks past the data of IDAT chunks instead of
+	// reading it, for fast metadata scans: the header fields, ChunkTypes,
+	// IDATSize and the ancillary chunks are available, but Img is nil and
+	// IDAT chunks have nil Data. Their CRC can't be checked and they are
+	// not passed to the ChunkRewriter. It needs a reader that can seek.
+	SkipIDAT bool
+
+	// IgnoreCRC, when set, accepts chunks whose stored CRC doesn't match
+	// their contents, as some CgBI files in the wild have on purpose. The
+	// stored value stays in Chunk.Crc32; ChunkCRC gives the correct one.
+	IgnoreCRC bool
+}
+
+// DefaultIDATChunkSize is the largest IDAT chunk the encoders write when
+// EncodeOptions.IDATChunkSize is 0.
+const DefaultIDATChunkSize = 1 << 16
+
+// EncodeOptions tunes how EncodeWithOptions and EncodeCgBIWithOptions write
+// a PNG. The zero value gives the same result as Encode and EncodeCgBI.
+type EncodeOptions struct {
+	// IDATChunkSize is the maximum number of bytes per IDAT chunk, 0 for
+	// DefaultIDATChunkSize. image/png already writes smaller chunks than
+	// that, so standard PNGs are only split differently when it is set.
+	IDATChunkSize int
+
+	// ChunkOrder, when set, lists chunk types in the order EncodeWithOptions
+	// writes them, e.g. {"IHDR", "sRGB", "gAMA", "pHYs", "IDAT", "IEND"}, to
+	// match the output of another tool byte for byte. It must hold IDAT,
+	// which the others are placed around. IHDR always comes first and IEND
+	// last. Chunks of a type that is not listed keep their side of IDAT and
+	// their order, and go right before IDAT or right before IEND. Beyond
+	// that the order is not checked against the PNG spec. EncodeCgBI writes
+	// no ancillary chunks and ignores it.
+	ChunkOrder []string
+}
@@ -0,0 +1,49 @@
+package ipaPng
+
+import (
+	"sync"
+)
+
+// A BufferPool recycles chunk data buffers across decodes, which saves
+// allocations when many files are decoded in a row. Pass it through
+// DecodeOptions.BufferPool. The buffers of a decoded file, including every
+// Chunk.Data, belong to its IpaPNG until Release is called; after that the
+// chunk data must not be used anymore. Copy what needs to outlive Release.
+type BufferPool struct {
+	p sync.Pool
+}
+
+// NewBufferPool returns an empty BufferPool.
+func NewBufferPool() *BufferPool {
+	return &BufferPool{}
+}
+
+// get returns a buffer of length n, reusing a pooled one when it is big enough.
+func (bp *BufferPool) get(n int) []byte {
+	if b, ok := bp.p.Get().(*[]byte); ok && cap(*b) >= n {
+		return (*b)[:n]
+	}
+	return make([]byte, n)
+}
+
+// put hands b back to the pool.
+func (bp *BufferPool) put(b []byte) {
+	if cap(b) == 0 {
+		return
+	}
+	bp.p.Put(&b)
+}
+
+// Release returns the chunk data buffers to DecodeOptions.BufferPool and
+// clears Chunk.Data of every chunk. The decoded image stays valid. Without a
+// BufferPool, Release does nothing.
+func (cgbi *IpaPNG) Release() {
+	bp := cgbi.opts.BufferPool
+	if bp == nil {
+		return
+	}
+	for _, c := range cgbi.chunks {
+		bp.put(c.Data)
+		c.Data = nil
+	}
+}
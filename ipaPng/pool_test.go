@@ -0,0 +1,115 @@
+package ipaPng
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+)
+
+// pooledTestFile returns a CgBI file of noise, so that it has plenty of
+// IDAT data, spread over many chunks whose buffers the pool can recycle.
+func pooledTestFile(t testing.TB, width, height int) []byte {
+	img := testImage(width, height)
+	x := uint32(1)
+	for i := range img.Pix {
+		if i%4 != 3 {
+			x = x*1664525 + 1013904223
+			img.Pix[i] = uint8(x >> 24)
+		}
+	}
+	var b bytes.Buffer
+	if err := FromImage(img).EncodeCgBIWithOptions(&b, EncodeOptions{IDATChunkSize: 4096}); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func BenchmarkDecodeBufferPool(b *testing.B) {
+	f := pooledTestFile(b, 256, 256)
+	for _, bench := range []struct {
+		name string
+		pool *BufferPool
+	}{
+		{"none", nil},
+		{"pool", NewBufferPool()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cgbi, err := DecodeWithOptions(bytes.NewReader(f), DecodeOptions{BufferPool: bench.pool})
+				if err != nil {
+					b.Fatal(err)
+				}
+				cgbi.Release()
+			}
+		})
+	}
+}
+
+// TestBufferPoolConcurrent decodes and re-encodes different images at once
+// through one pool, to be run with -race.
+func TestBufferPoolConcurrent(t *testing.T) {
+	const n = 100
+	pool := NewBufferPool()
+	imgs := make([]*image.NRGBA, n)
+	files := make([][]byte, n)
+	for i := range files {
+		imgs[i] = testImage(8+i%13, 4+i/13)
+		var b bytes.Buffer
+		if err := FromImage(imgs[i]).EncodeCgBIWithOptions(&b, EncodeOptions{IDATChunkSize: 64}); err != nil {
+			t.Fatal(err)
+		}
+		files[i] = b.Bytes()
+	}
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- pooledRoundTrip(files[i], imgs[i], pool)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// pooledRoundTrip decodes the CgBI file f of want with pool, encodes it as
+// a standard PNG and decodes that again, checking the pixels each time.
+func pooledRoundTrip(f []byte, want *image.NRGBA, pool *BufferPool) error {
+	cgbi, err := DecodeWithOptions(bytes.NewReader(f), DecodeOptions{BufferPool: pool})
+	if err != nil {
+		return err
+	}
+	defer cgbi.Release()
+	var b bytes.Buffer
+	if err := cgbi.EncodeWithOptions(&b, EncodeOptions{IDATChunkSize: 100}); err != nil {
+		return err
+	}
+	out, err := DecodeWithOptions(bytes.NewReader(b.Bytes()), DecodeOptions{BufferPool: pool})
+	if err != nil {
+		return err
+	}
+	defer out.Release()
+	for _, img := range []image.Image{cgbi.Img, out.Img} {
+		if img.Bounds().Size() != want.Bounds().Size() {
+			return fmt.Errorf("size %v, want %v", img.Bounds().Size(), want.Bounds().Size())
+		}
+		for y := 0; y < want.Rect.Dy(); y++ {
+			for x := 0; x < want.Rect.Dx(); x++ {
+				if c := color.NRGBAModel.Convert(img.At(x, y)); c != want.NRGBAAt(x, y) {
+					return fmt.Errorf("%v: pixel %d,%d is %v, want %v", want.Rect.Size(), x, y, c, want.NRGBAAt(x, y))
+				}
+			}
+		}
+	}
+	return nil
+}
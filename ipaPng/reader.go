@@ -1,44 +1,167 @@
 package ipaPng
 
 import (
-	"hash/crc32"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"image"
 	"io"
+	"io/ioutil"
+	"time"
 )
 
 // Decode reads a PNG image from r and returns it as an image.Image.
 // The type of Image returned depends on the PNG contents.
+// The package keeps no mutable state, so Decode may be called from many
+// goroutines at once, each with its own reader; a BufferPool may be shared.
 func Decode(r io.ReadSeeker) (*IpaPNG, error) {
+	return DecodeWithOptions(r, DecodeOptions{})
+}
+
+// DecodeImage decodes a CgBI or standard PNG image from r and returns just
+// the image, for callers that need nothing else from the file. Readers that
+// can't seek are read into memory first.
+func DecodeImage(r io.Reader) (image.Image, error) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, stageError(StageSignature, err)
+		}
+		rs = bytes.NewReader(b)
+	}
+	cgbi, err := Decode(rs)
+	if err != nil {
+		return nil, err
+	}
+	return cgbi.Img, nil
+}
+
+// DecodeWithOptions is like Decode, with opts tuning how a CgBI file is decoded.
+func DecodeWithOptions(r io.ReadSeeker, opts DecodeOptions) (*IpaPNG, error) {
+	r, err := gunzip(r)
+	if err != nil {
+		return nil, stageError(StageSignature, err)
+	}
 	cgbi := &IpaPNG{
 		r:    r,
-		crc:  crc32.NewIEEE(),
-		IDAT: []byte{120, 156}, // default set zlib header
+		IDAT: append([]byte(nil), zlibHeader...), // CgBI IDAT data lacks the zlib header
+		opts: opts,
 	}
-	if err := cgbi.checkHeader(); err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
-		}
+	if opts.Instrument {
+		cgbi.timings = make(map[string]time.Duration)
+	}
+	start := cgbi.clock()
+	chunks, err := parseChunks(cgbi.r, opts)
+	if err != nil {
+		return nil, err
+	}
+	cgbi.lap(PhaseParse, &start)
+	cgbi.chunks = chunks
+
+	//do parse chunk
+	err = cgbi.parseChunk()
+	if err != nil {
 		return nil, err
 	}
+	return cgbi, nil
+}
+
+// ParseChunks reads the PNG signature and the chunks up to and including
+// IEND from r, without decoding the image. Every chunk's CRC is checked and
+// its Position relative to the IDAT run is set.
+func ParseChunks(r io.Reader) ([]*Chunk, error) {
+	return parseChunks(r, DecodeOptions{})
+}
+
+// ParseChunksWithOptions is like ParseChunks, applying the chunk level
+// options of opts: BufferPool, ChunkRewriter, SkipIDAT and IgnoreCRC.
+func ParseChunksWithOptions(r io.Reader, opts DecodeOptions) ([]*Chunk, error) {
+	return parseChunks(r, opts)
+}
+
+// parseChunks is ParseChunksWithOptions.
+func parseChunks(r io.Reader, opts DecodeOptions) ([]*Chunk, error) {
+	var chunks []*Chunk
+	err := forEachChunk(r, opts, func(c *Chunk) error {
+		chunks = append(chunks, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// forEachChunk reads the PNG signature and then passes the chunks up to and
+// including IEND to fn as they are read, applying the chunk level options
+// of opts. It stops at the first error, from reading or from fn.
+func forEachChunk(r io.Reader, opts DecodeOptions, fn func(*Chunk) error) error {
+	var before func(*Chunk)
+	if opts.RewriteBeforeCRC {
+		before = opts.ChunkRewriter
+	}
+	var skip io.Seeker
+	if opts.SkipIDAT {
+		var ok bool
+		if skip, ok = r.(io.Seeker); !ok {
+			return stageError(StageChunk, errors.New("SkipIDAT needs a reader that can seek"))
+		}
+	}
+	if err := checkHeader(r); err != nil {
+		return stageError(StageSignature, err)
+	}
 	stage := dsStart
+	position := PositionBeforeIDAT
 	for stage != dsSeenIEND {
-		c := Chunk{
-			crc: crc32.NewIEEE(),
-		}
-		err := (&c).Populate(cgbi.r)
+		c := Chunk{}
+		err := (&c).populate(r, opts.BufferPool, before, skip, opts.IgnoreCRC)
 		if err != nil {
-			return nil, err
+			return stageError(StageChunk, err)
+		}
+		if c.CType == dsSeenIDAT {
+			position = PositionIDAT
+		} else if position == PositionIDAT {
+			position = PositionAfterIDAT
+		}
+		c.Position = position
+		if opts.ChunkRewriter != nil && !opts.RewriteBeforeCRC && !(skip != nil && c.CType == dsSeenIDAT) {
+			opts.ChunkRewriter(&c)
+			c.Length = uint32(len(c.Data))
 		}
 		// Drop the last empty chunk.
 		if c.CType != "" {
-			cgbi.chunks = append(cgbi.chunks, &c)
+			if err := fn(&c); err != nil {
+				return err
+			}
 		}
 		stage = c.CType
 	}
+	return nil
+}
 
-	//do parse chunk
-	err := cgbi.parseChunk()
+// gzipMagic starts every gzip stream.
+const gzipMagic = "\x1f\x8b"
+
+// gunzip returns r itself, rewound, unless it holds a gzip stream (as in a
+// .png.gz file). That is decompressed into memory and returned instead.
+func gunzip(r io.ReadSeeker) (io.ReadSeeker, error) {
+	magic := make([]byte, len(gzipMagic))
+	n, _ := io.ReadFull(r, magic)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if n < len(magic) || string(magic) != gzipMagic {
+		return r, nil
+	}
+	zr, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
-	return cgbi, nil
+	defer zr.Close()
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
 }
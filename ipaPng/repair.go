@@ -0,0 +1,26 @@
+package ipaPng
+
+import "io"
+
+// RepairCRCs copies the PNG in r to w chunk by chunk, with every CRC
+// recomputed and nothing else changed: a CgBI file keeps its CgBI chunk and
+// its IDAT data as they are, so it stays a CgBI file that Apple's tools
+// accept, unlike one converted with Encode. Anything after IEND is dropped.
+// All chunks are read before the first byte is written, so w gets nothing
+// when r can't be parsed. It returns the number of chunks whose CRC was
+// wrong and the number of chunks.
+func RepairCRCs(r io.Reader, w io.Writer) (fixed, total int, err error) {
+	chunks, err := ParseChunksWithOptions(r, DecodeOptions{IgnoreCRC: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, c := range chunks {
+		if c.Crc32 != ChunkCRC(c.CType, c.Data) {
+			fixed++
+		}
+	}
+	if err := WriteChunks(w, chunks); err != nil {
+		return 0, 0, err
+	}
+	return fixed, len(chunks), nil
+}
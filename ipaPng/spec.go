@@ -0,0 +1,125 @@
+package ipaPng
+
+import (
+	"fmt"
+	"io"
+)
+
+// Ancillary chunks the PNG spec places relative to PLTE and IDAT, and those
+// that may appear only once.
+var (
+	specBeforePLTE = []string{"cHRM", "gAMA", "iCCP", "sBIT", "sRGB"}
+	specAfterPLTE  = []string{"bKGD", "hIST", "tRNS"}
+	specBeforeIDAT = []string{"PLTE", "pHYs", "sPLT", "cHRM", "gAMA", "iCCP", "sBIT", "sRGB", "bKGD", "hIST", "tRNS"}
+	specOnce       = []string{"IHDR", "PLTE", "IEND", "cHRM", "gAMA", "iCCP", "sBIT", "sRGB", "bKGD", "hIST", "tRNS", "pHYs", "tIME"}
+)
+
+// CheckSpec reads the PNG in r and returns how it breaks the PNG spec, none
+// for a compliant file. It checks the signature and every chunk CRC, that
+// IHDR comes first and nothing follows IEND, that the critical chunks are
+// there (IHDR, IDAT and PLTE for paletted images) without duplicates or
+// unknown ones, that IDAT is a single contiguous run, that PLTE and the
+// ancillary chunks are on the side of PLTE and IDAT the spec puts them, and
+// that ancillary chunks allowed once appear once. CgBI files break it by
+// design, with their CgBI chunk.
+func CheckSpec(r io.Reader) []string {
+	chunks, err := parseChunks(r, DecodeOptions{IgnoreCRC: true})
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var violations []string
+	add := func(format string, a ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, a...))
+	}
+	misplaced := func(c, relation, other string, idx int) {
+		violations = append(violations, (&ChunkOrderError{Chunk: c, Relation: relation, Other: other, Index: idx}).Error())
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		add("data follows IEND")
+	}
+	if len(chunks) == 0 {
+		return append(violations, "no chunks")
+	}
+	if chunks[0].CType != dsSeenIHDR {
+		add("the first chunk is %v, not IHDR", chunks[0].CType)
+	}
+
+	first := make(map[string]int)
+	lastIDAT := -1
+	for i, c := range chunks {
+		if ChunkCRC(c.CType, c.Data) != c.Crc32 {
+			add("wrong CRC for %v (chunk #%d)", c.CType, i)
+		}
+		if len(c.CType) == 4 && c.CType[2] >= 'a' {
+			add("reserved bit set in the type of %v (chunk #%d)", c.CType, i)
+		}
+		if len(c.CType) == 4 && c.CType[0] < 'a' && !isCriticalChunk(c.CType) {
+			add("unknown critical chunk %v (chunk #%d)", c.CType, i)
+		}
+		if _, ok := first[c.CType]; ok {
+			if containsType(specOnce, c.CType) {
+				misplaced(c.CType, "", c.CType, i)
+			}
+		} else {
+			first[c.CType] = i
+		}
+		if c.CType == dsSeenIDAT {
+			if lastIDAT >= 0 && lastIDAT != i-1 {
+				add("IDAT chunks are not contiguous: chunk #%d is %v", lastIDAT+1, chunks[lastIDAT+1].CType)
+			}
+			lastIDAT = i
+		}
+	}
+
+	plte, hasPLTE := first["PLTE"]
+	idat, hasIDAT := first[dsSeenIDAT]
+	if !hasIDAT {
+		add("missing IDAT chunk")
+	}
+	if ihdr := chunks[0]; ihdr.CType == dsSeenIHDR && len(ihdr.Data) == int(iHDRLength) {
+		switch ihdr.Data[9] {
+		case ctPaletted:
+			if !hasPLTE {
+				add("missing PLTE chunk for a paletted image")
+			}
+		case ctGrayscale, ctGrayscaleAlpha:
+			if hasPLTE {
+				add("PLTE chunk in a grayscale image")
+			}
+		}
+	}
+	if _, ok := first["hIST"]; ok && !hasPLTE {
+		add("hIST chunk without PLTE")
+	}
+	_, hasICCP := first["iCCP"]
+	if _, hasSRGB := first["sRGB"]; hasICCP && hasSRGB {
+		add("both iCCP and sRGB chunks")
+	}
+	for i, c := range chunks {
+		switch {
+		case hasPLTE && i > plte && containsType(specBeforePLTE, c.CType):
+			misplaced(c.CType, "after", "PLTE", i)
+		case hasPLTE && i < plte && containsType(specAfterPLTE, c.CType):
+			misplaced(c.CType, "before", "PLTE", i)
+		case hasIDAT && i > idat && containsType(specBeforeIDAT, c.CType):
+			misplaced(c.CType, "after", dsSeenIDAT, i)
+		}
+	}
+	return violations
+}
+
+// isCriticalChunk reports whether cType is one of the critical chunks the
+// PNG spec defines.
+func isCriticalChunk(cType string) bool {
+	return cType == dsSeenIHDR || cType == "PLTE" || cType == dsSeenIDAT || cType == dsSeenIEND
+}
+
+// containsType reports whether types holds cType.
+func containsType(types []string, cType string) bool {
+	for _, t := range types {
+		if t == cType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package ipaPng
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AddText returns chunks with a tEXt chunk holding keyword and text inserted
+// right before IEND, e.g. AddText(chunks, "Comment", "fixed by cgbifix").
+// The keyword must be 1 to 79 characters and neither it nor the text may
+// contain a NUL byte, as PNG requires. Write the result with WriteChunks.
+func AddText(chunks []*Chunk, keyword, text string) ([]*Chunk, error) {
+	if len(keyword) < 1 || len(keyword) > 79 || strings.IndexByte(keyword, 0) >= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid tEXt keyword %q", keyword))
+	}
+	if strings.IndexByte(text, 0) >= 0 {
+		return nil, errors.New("tEXt text must not contain NUL")
+	}
+	end := len(chunks)
+	if end > 0 && chunks[end-1].CType == dsSeenIEND {
+		end--
+	}
+	data := []byte(keyword + "\x00" + text)
+	c := &Chunk{Length: uint32(len(data)), CType: "tEXt", Data: data, Crc32: ChunkCRC("tEXt", data), Position: PositionAfterIDAT}
+	out := make([]*Chunk, 0, len(chunks)+1)
+	out = append(out, chunks[:end]...)
+	out = append(out, c)
+	return append(out, chunks[end:]...), nil
+}
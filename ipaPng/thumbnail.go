@@ -0,0 +1,58 @@
+package ipaPng
+
+import (
+	"image"
+)
+
+// Thumbnail returns the decoded image scaled down to fit into a square of
+// maxSize pixels, keeping its aspect ratio. Every thumbnail pixel is the
+// alpha weighted average of the source pixels it covers. Images that fit
+// already are returned at their own size.
+func (cgbi *IpaPNG) Thumbnail(maxSize int) *image.NRGBA {
+	if cgbi.Img == nil || maxSize < 1 {
+		return nil
+	}
+	src := toNRGBA(cgbi.Img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	tw, th := w, h
+	if w > maxSize || h > maxSize {
+		if w >= h {
+			tw, th = maxSize, (h*maxSize+w/2)/w
+		} else {
+			tw, th = (w*maxSize+h/2)/h, maxSize
+		}
+		if tw < 1 {
+			tw = 1
+		}
+		if th < 1 {
+			th = 1
+		}
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := ty*h/th, (ty+1)*h/th
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := tx*w/tw, (tx+1)*w/tw
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				pix := src.Pix[y*src.Stride+x0*4 : y*src.Stride+x1*4]
+				for x := 0; x < len(pix); x += 4 {
+					pa := uint64(pix[x+3])
+					r += uint64(pix[x+0]) * pa
+					g += uint64(pix[x+1]) * pa
+					b += uint64(pix[x+2]) * pa
+					a += pa
+					n++
+				}
+			}
+			d := dst.Pix[ty*dst.Stride+tx*4 : ty*dst.Stride+tx*4+4]
+			if a > 0 {
+				d[0] = uint8((r + a/2) / a)
+				d[1] = uint8((g + a/2) / a)
+				d[2] = uint8((b + a/2) / a)
+				d[3] = uint8((a + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
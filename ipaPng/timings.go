@@ -0,0 +1,49 @@
+package ipaPng
+
+import "time"
+
+// Decoding phases timed when DecodeOptions.Instrument is set, the keys of
+// Timings. Inflating, unfiltering and converting alternate row by row, so
+// each is the sum over all rows.
+const (
+	PhaseParse    = "parse"    // reading the chunks and checking their CRCs
+	PhaseInflate  = "inflate"  // inflating the IDAT data
+	PhaseDefilter = "defilter" // undoing the row filters
+	PhaseConvert  = "convert"  // turning the rows into colors, merging Adam7 passes
+	PhaseChecksum = "checksum" // checking the Adler-32 with VerifyChecksum
+	PhasePNG      = "png"      // decoding a standard PNG with image/png
+)
+
+// Timings returns the time spent in every decoding phase, keyed by the Phase
+// constants, or nil unless DecodeOptions.Instrument was set. Phases that
+// didn't run for the file are missing. OnRow callbacks are not counted.
+func (cgbi *IpaPNG) Timings() map[string]time.Duration {
+	if cgbi.timings == nil {
+		return nil
+	}
+	timings := make(map[string]time.Duration, len(cgbi.timings))
+	for phase, d := range cgbi.timings {
+		timings[phase] = d
+	}
+	return timings
+}
+
+// clock returns the current time when instrumenting and the zero time
+// otherwise, sparing the clock reads.
+func (cgbi *IpaPNG) clock() time.Time {
+	if cgbi.timings == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// lap adds the time since *since to phase and restarts *since, when
+// instrumenting.
+func (cgbi *IpaPNG) lap(phase string, since *time.Time) {
+	if cgbi.timings == nil {
+		return
+	}
+	now := time.Now()
+	cgbi.timings[phase] += now.Sub(*since)
+	*since = now
+}
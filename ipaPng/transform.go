@@ -0,0 +1,129 @@
+package ipaPng
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// FlipVertical mirrors img top to bottom, in place.
+func FlipVertical(img *image.NRGBA) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < h/2; y++ {
+		top := img.Pix[y*img.Stride : y*img.Stride+w*4]
+		bottom := img.Pix[(h-1-y)*img.Stride : (h-1-y)*img.Stride+w*4]
+		for i := range top {
+			top[i], bottom[i] = bottom[i], top[i]
+		}
+	}
+}
+
+// FlipHorizontal mirrors img left to right, in place.
+func FlipHorizontal(img *image.NRGBA) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+w*4]
+		for l, r := 0, (w-1)*4; l < r; l, r = l+4, r-4 {
+			for k := 0; k < 4; k++ {
+				row[l+k], row[r+k] = row[r+k], row[l+k]
+			}
+		}
+	}
+}
+
+// Rotate90 returns img rotated by 90 degrees clockwise. Unlike the flips it
+// needs a new image, as width and height trade places.
+func Rotate90(img *image.NRGBA) *image.NRGBA {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, h, w))
+	for y := 0; y < h; y++ {
+		src := img.Pix[y*img.Stride : y*img.Stride+w*4]
+		// Row y of the source becomes column h-1-y of the result.
+		off := (h - 1 - y) * 4
+		for x := 0; x < w; x++ {
+			copy(dst.Pix[off:off+4], src[x*4:x*4+4])
+			off += dst.Stride
+		}
+	}
+	return dst
+}
+
+// SliceVertical splits the decoded image into n frames of equal height, top
+// to bottom, as filmstrips pack animation frames. The height must be a
+// multiple of n. The frames share the pixels of Img and keep its
+// coordinates, so frame i starts at row i*height/n; image/png and the other
+// encoders take care of that.
+func (cgbi *IpaPNG) SliceVertical(n int) ([]image.Image, error) {
+	if cgbi.Img == nil {
+		return nil, errors.New("no decoded image to slice")
+	}
+	b := cgbi.Img.Bounds()
+	if n < 1 || b.Dy()%n != 0 {
+		return nil, errors.New(fmt.Sprintf("can't slice a height of %d into %d equal frames", b.Dy(), n))
+	}
+	img, ok := cgbi.Img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		img = toNRGBA(cgbi.Img)
+		b = img.(image.Image).Bounds()
+	}
+	h := b.Dy() / n
+	frames := make([]image.Image, n)
+	for i := range frames {
+		frames[i] = img.SubImage(image.Rect(b.Min.X, b.Min.Y+i*h, b.Max.X, b.Min.Y+(i+1)*h))
+	}
+	return frames, nil
+}
+
+// TrimTransparent returns the decoded image cropped to the smallest
+// rectangle holding every pixel that is not fully transparent, e.g. an icon
+// without its padding. Like the frames of SliceVertical the result shares
+// the pixels of Img and keeps its coordinates. A fully transparent image
+// trims down to a single transparent pixel, with a warning. Without a
+// decoded image it returns nil.
+func (cgbi *IpaPNG) TrimTransparent() image.Image {
+	if cgbi.Img == nil {
+		return nil
+	}
+	img, ok := cgbi.Img.(interface {
+		image.Image
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		img = toNRGBA(cgbi.Img)
+	}
+	visible := func(x, y int) bool {
+		_, _, _, a := img.At(x, y).RGBA()
+		return a != 0
+	}
+	if n, ok := img.(*image.NRGBA); ok {
+		visible = func(x, y int) bool {
+			return n.Pix[n.PixOffset(x, y)+3] != 0
+		}
+	}
+	b := img.Bounds()
+	trim := image.Rectangle{Min: b.Max, Max: b.Min}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !visible(x, y) {
+				continue
+			}
+			if x < trim.Min.X {
+				trim.Min.X = x
+			}
+			if x >= trim.Max.X {
+				trim.Max.X = x + 1
+			}
+			if y < trim.Min.Y {
+				trim.Min.Y = y
+			}
+			trim.Max.Y = y + 1
+		}
+	}
+	if trim.Empty() {
+		cgbi.warn("the image is fully transparent, trimmed to a single pixel")
+		return image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	}
+	return img.SubImage(trim)
+}
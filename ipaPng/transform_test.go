@@ -0,0 +1,40 @@
+package ipaPng
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFlipRotate(t *testing.T) {
+	const w, h = 3, 2
+	tests := []struct {
+		name      string
+		transform func(*image.NRGBA) *image.NRGBA
+		size      image.Point
+		// where the pixel at x, y of the source ends up
+		to func(x, y int) (int, int)
+	}{
+		{"FlipVertical", func(img *image.NRGBA) *image.NRGBA { FlipVertical(img); return img },
+			image.Pt(w, h), func(x, y int) (int, int) { return x, h - 1 - y }},
+		{"FlipHorizontal", func(img *image.NRGBA) *image.NRGBA { FlipHorizontal(img); return img },
+			image.Pt(w, h), func(x, y int) (int, int) { return w - 1 - x, y }},
+		{"Rotate90", Rotate90,
+			image.Pt(h, w), func(x, y int) (int, int) { return h - 1 - y, x }},
+	}
+	for _, tt := range tests {
+		src := testImage(w, h)
+		got := tt.transform(testImage(w, h))
+		if got.Bounds().Size() != tt.size {
+			t.Errorf("%v: size %v, want %v", tt.name, got.Bounds().Size(), tt.size)
+			continue
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				tx, ty := tt.to(x, y)
+				if c := got.NRGBAAt(tx, ty); c != src.NRGBAAt(x, y) {
+					t.Errorf("%v: pixel %d,%d is %v at %d,%d, want %v", tt.name, x, y, c, tx, ty, src.NRGBAAt(x, y))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package ipaPng
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// APNG chunk types. acTL announces the animation, every frame starts with
+// an fcTL and its image data is in the IDAT chunks for the first frame and
+// in fdAT chunks for the others.
+const (
+	apngACTL = "acTL"
+	apngFCTL = "fcTL"
+	apngFDAT = "fdAT"
+)
+
+// PrintChunkTree is like PrintChunks, but lists the chunks as a tree with
+// their sizes instead of their data: for APNG files every fcTL opens a
+// frame holding the IDAT or fdAT chunks after it, and the first line counts
+// the frames.
+func (cgbi *IpaPNG) PrintChunkTree() string {
+	return ChunkTree(cgbi.chunks)
+}
+
+// ChunkTree renders chunks, as from ParseChunks, the way PrintChunkTree
+// does.
+func ChunkTree(chunks []*Chunk) string {
+	var b strings.Builder
+	frames, declared := 0, -1
+	for _, c := range chunks {
+		switch c.CType {
+		case apngFCTL:
+			frames++
+		case apngACTL:
+			if len(c.Data) >= 8 {
+				declared = int(binary.BigEndian.Uint32(c.Data))
+			}
+		}
+	}
+	kind := "PNG"
+	if len(chunks) > 0 && chunks[0].CType == dsSeenCgBI {
+		kind = "CgBI PNG"
+	}
+	fmt.Fprintf(&b, "%v, %d chunks", kind, len(chunks))
+	if frames > 0 || declared >= 0 {
+		fmt.Fprintf(&b, ", APNG with %d frames", frames)
+		if declared >= 0 && declared != frames {
+			fmt.Fprintf(&b, " (acTL declares %d)", declared)
+		}
+	}
+	b.WriteString("\n")
+
+	frame := 0
+	inFrame := false
+	for _, c := range chunks {
+		switch c.CType {
+		case apngFCTL:
+			frame++
+			inFrame = true
+			fmt.Fprintf(&b, "  frame %d: %v\n", frame, describeChunk(c))
+			continue
+		case dsSeenIDAT, apngFDAT:
+		default:
+			inFrame = false
+		}
+		indent := "  "
+		if inFrame {
+			indent = "    "
+		}
+		fmt.Fprintf(&b, "%v%v\n", indent, describeChunk(c))
+	}
+	return b.String()
+}
+
+// describeChunk returns the type and length of c and, for the APNG chunks,
+// the fields worth seeing.
+func describeChunk(c *Chunk) string {
+	s := fmt.Sprintf("%v %d bytes", c.CType, c.Length)
+	d := c.Data
+	switch {
+	case c.CType == apngACTL && len(d) >= 8:
+		s += fmt.Sprintf(", %d frames, %d plays", binary.BigEndian.Uint32(d), binary.BigEndian.Uint32(d[4:]))
+	case c.CType == apngFCTL && len(d) >= 26:
+		s += fmt.Sprintf(", sequence %d, %dx%d at %d,%d, delay %d/%d s, dispose %d, blend %d",
+			binary.BigEndian.Uint32(d), binary.BigEndian.Uint32(d[4:]), binary.BigEndian.Uint32(d[8:]),
+			binary.BigEndian.Uint32(d[12:]), binary.BigEndian.Uint32(d[16:]),
+			binary.BigEndian.Uint16(d[20:]), binary.BigEndian.Uint16(d[22:]), d[24], d[25])
+	case c.CType == apngFDAT && len(d) >= 4:
+		s += fmt.Sprintf(", sequence %d", binary.BigEndian.Uint32(d))
+	}
+	return s
+}
@@ -0,0 +1,64 @@
+package ipaPng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// RoundTripError reports where a re-encoded CgBI file first diverged from
+// the original bytes.
+type RoundTripError struct {
+	Chunk       string // type of the chunk holding the first differing byte
+	ChunkOffset int    // file offset of that chunk
+	Offset      int    // file offset of the first differing byte
+}
+
+func (e *RoundTripError) Error() string {
+	return fmt.Sprintf("round trip differs in chunk %v (at %d), first differing byte at offset %d",
+		e.Chunk, e.ChunkOffset, e.Offset)
+}
+
+// VerifyRoundTrip decodes original, re-encodes it with EncodeCgBI and
+// reports whether the result is byte-for-byte identical to original.
+// Apple's deflate output is rarely reproduced exactly, so on a mismatch a
+// *RoundTripError is returned describing where the files diverged.
+func VerifyRoundTrip(original []byte) (bool, error) {
+	cgbi, err := Decode(bytes.NewReader(original))
+	if err != nil {
+		return false, err
+	}
+	if !cgbi.IsCgBI {
+		return false, errors.New("not a CgBI file")
+	}
+	var out bytes.Buffer
+	if err := cgbi.EncodeCgBI(&out); err != nil {
+		return false, err
+	}
+	encoded := out.Bytes()
+	if bytes.Equal(original, encoded) {
+		return true, nil
+	}
+
+	offset := 0
+	for offset < len(original) && offset < len(encoded) && original[offset] == encoded[offset] {
+		offset++
+	}
+	return false, locateDiff(original, offset)
+}
+
+// locateDiff finds the chunk of file that contains offset.
+func locateDiff(file []byte, offset int) *RoundTripError {
+	e := &RoundTripError{Chunk: "signature", Offset: offset}
+	pos := len(pngHeader)
+	for pos+8 <= len(file) && pos <= offset {
+		e.Chunk = string(file[pos+4 : pos+8])
+		e.ChunkOffset = pos
+		pos += 12 + int(binary.BigEndian.Uint32(file[pos:pos+4]))
+	}
+	if offset >= pos {
+		e.Chunk, e.ChunkOffset = "EOF", pos
+	}
+	return e
+}
@@ -0,0 +1,332 @@
+package ipaPng
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// This file holds a small WebP encoder. golang.org/x/image/webp only
+// decodes, and the pure Go encoders around need a newer Go than this
+// module, while libwebp would need cgo. So EncodeWebP writes the lossless
+// VP8L format itself, in its simplest form: no transforms, no color cache
+// and no backward references, just one set of prefix codes for the pixels.
+// See https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+
+// EncodeWebP writes the decoded image to w as a WebP image. The output is
+// always the lossless VP8L format. With lossless false, quality (1 to 100)
+// trades exactness for size: the color channels are rounded to fewer
+// significant bits the lower it is (none at 100), and the colors of fully
+// transparent pixels are dropped, before lossless coding. Alpha is kept
+// exactly. 16-bit samples are truncated to 8 bits, which is recorded in
+// Warnings.
+func (cgbi *IpaPNG) EncodeWebP(w io.Writer, lossless bool, quality int) error {
+	if cgbi.Img == nil {
+		return errors.New("no decoded image to encode")
+	}
+	if !lossless && (quality < 1 || quality > 100) {
+		return errors.New(fmt.Sprintf("invalid WebP quality %v, expected 1 to 100", quality))
+	}
+	nRgba := toNRGBA(cgbi.Img)
+	width, height := nRgba.Rect.Dx(), nRgba.Rect.Dy()
+	if width < 1 || height < 1 {
+		return errors.New(fmt.Sprintf("empty image of %dx%d, nothing to encode as WebP", width, height))
+	}
+	if width > 1<<14 || height > 1<<14 {
+		return errors.New(fmt.Sprintf("image of %dx%d is too large for WebP, the limit is 16384x16384", width, height))
+	}
+	cgbi.warnDepth()
+
+	// Collect the pixels as ARGB, applying the lossy rounding.
+	var shift uint
+	if !lossless {
+		shift = uint(100-quality+24) / 25
+	}
+	argb := make([][4]uint8, 0, width*height)
+	opaque := true
+	for y := 0; y < height; y++ {
+		pix := nRgba.Pix[y*nRgba.Stride : y*nRgba.Stride+width*4]
+		for x := 0; x < len(pix); x += 4 {
+			p := [4]uint8{pix[x+3], pix[x], pix[x+1], pix[x+2]}
+			if shift > 0 {
+				if p[0] == 0 {
+					p = [4]uint8{}
+				}
+				for i := 1; i < 4; i++ {
+					p[i] = roundBits(p[i], shift)
+				}
+			}
+			opaque = opaque && p[0] == 0xff
+			argb = append(argb, p)
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8) // VP8L signature
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if opaque {
+		bw.write(0, 1)
+	} else {
+		bw.write(1, 1)
+	}
+	bw.write(0, 3) // version
+	bw.write(0, 1) // no transform
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // a single prefix code group for the whole image
+
+	// The prefix codes come in the order green, red, blue, alpha and
+	// distance, while pixels are ARGB.
+	var green [256 + 24]int
+	var red, blue, alpha [256]int
+	for _, p := range argb {
+		alpha[p[0]]++
+		red[p[1]]++
+		green[p[2]]++
+		blue[p[3]]++
+	}
+	codes := [4]prefixCode{
+		writePrefixCode(bw, green[:]),
+		writePrefixCode(bw, red[:]),
+		writePrefixCode(bw, blue[:]),
+		writePrefixCode(bw, alpha[:]),
+	}
+	writePrefixCode(bw, make([]int, 40)) // distances are unused
+	for _, p := range argb {
+		codes[0].write(bw, int(p[2]))
+		codes[1].write(bw, int(p[1]))
+		codes[2].write(bw, int(p[3]))
+		codes[3].write(bw, int(p[0]))
+	}
+	data := bw.flush()
+
+	// RIFF container: the VP8L chunk is padded to an even size.
+	size := len(data) + len(data)&1
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+size))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if len(data)&1 == 1 {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// roundBits rounds v to the nearest value whose lowest shift bits are 0.
+func roundBits(v uint8, shift uint) uint8 {
+	r := (uint(v) + 1<<(shift-1)) >> shift << shift
+	if r > 0xff {
+		r = 0xff >> shift << shift
+	}
+	return uint8(r)
+}
+
+// bitWriter packs values least significant bit first, as VP8L reads them.
+type bitWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	b.bits |= uint64(v) << b.n
+	b.n += n
+	for b.n >= 8 {
+		b.buf = append(b.buf, byte(b.bits))
+		b.bits >>= 8
+		b.n -= 8
+	}
+}
+
+// flush pads the last byte with zero bits and returns the written bytes.
+func (b *bitWriter) flush() []byte {
+	if b.n > 0 {
+		b.buf = append(b.buf, byte(b.bits))
+		b.bits, b.n = 0, 0
+	}
+	return b.buf
+}
+
+// A prefixCode holds the bit-reversed canonical code and its length for
+// every symbol of an alphabet. Symbols with length 0 take no bits, which is
+// also how a code with a single symbol is stored.
+type prefixCode struct {
+	codes   []uint16
+	lengths []uint8
+}
+
+func (p prefixCode) write(b *bitWriter, symbol int) {
+	b.write(uint32(p.codes[symbol]), uint(p.lengths[symbol]))
+}
+
+// codeLengthCodeOrder is the order in which the code lengths of the code
+// length code are stored.
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writePrefixCode writes a prefix code for the symbol frequencies counts to
+// b and returns it.
+func writePrefixCode(b *bitWriter, counts []int) prefixCode {
+	var symbols []int
+	for s, c := range counts {
+		if c > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		return writeSimplePrefixCode(b, len(counts), symbols)
+	}
+	lengths := huffmanLengths(counts, 15)
+	b.write(0, 1) // normal code
+	var clCounts [19]int
+	for _, l := range lengths {
+		clCounts[l]++
+	}
+	clLengths := huffmanLengths(clCounts[:], 7)
+	b.write(19-4, 4) // all 19 code length code lengths follow
+	for _, s := range codeLengthCodeOrder {
+		b.write(uint32(clLengths[s]), 3)
+	}
+	b.write(0, 1) // a code length for every symbol follows
+	cl := newPrefixCode(clLengths)
+	for _, l := range lengths {
+		cl.write(b, int(l))
+	}
+	return newPrefixCode(lengths)
+}
+
+// writeSimplePrefixCode writes the short form of a code for at most two
+// symbols below 256, given in increasing order. Without symbols it codes
+// symbol 0, which is then never written.
+func writeSimplePrefixCode(b *bitWriter, n int, symbols []int) prefixCode {
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+	b.write(1, 1) // simple code
+	b.write(uint32(len(symbols)-1), 1)
+	if symbols[0] < 2 {
+		b.write(0, 1)
+		b.write(uint32(symbols[0]), 1)
+	} else {
+		b.write(1, 1)
+		b.write(uint32(symbols[0]), 8)
+	}
+	p := prefixCode{codes: make([]uint16, n), lengths: make([]uint8, n)}
+	if len(symbols) == 2 {
+		b.write(uint32(symbols[1]), 8)
+		p.lengths[symbols[0]], p.lengths[symbols[1]] = 1, 1
+		p.codes[symbols[1]] = 1
+	}
+	return p
+}
+
+// newPrefixCode assigns the canonical codes for the code lengths.
+func newPrefixCode(lengths []uint8) prefixCode {
+	p := prefixCode{codes: make([]uint16, len(lengths)), lengths: append([]uint8(nil), lengths...)}
+	var count [16]int
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used == 1 {
+		// A lone symbol is coded with zero bits.
+		for i := range p.lengths {
+			p.lengths[i] = 0
+		}
+		return p
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		// Codes are read most significant bit first.
+		var r uint16
+		for i := uint8(0); i < l; i++ {
+			r = r<<1 | uint16(c>>i&1)
+		}
+		p.codes[s] = r
+	}
+	return p
+}
+
+// huffmanLengths returns Huffman code lengths of at most maxLength for the
+// symbol frequencies counts. A single used symbol gets length 1. When the
+// tree gets too deep the frequencies are flattened and it is built again.
+func huffmanLengths(counts []int, maxLength uint8) []uint8 {
+	lengths := make([]uint8, len(counts))
+	var symbols, weights []int
+	for s, c := range counts {
+		if c > 0 {
+			symbols = append(symbols, s)
+			weights = append(weights, c)
+		}
+	}
+	switch len(symbols) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[symbols[0]] = 1
+		return lengths
+	}
+	for {
+		n := len(weights)
+		weight := append(make([]int, 0, 2*n-1), weights...)
+		parent := make([]int, 2*n-1)
+		free := make([]int, n)
+		for i := range free {
+			free[i] = i
+		}
+		// Join the two lightest free nodes until one root is left.
+		for len(free) > 1 {
+			var pair [2]int
+			for k := range pair {
+				min := 0
+				for i := range free {
+					if weight[free[i]] < weight[free[min]] {
+						min = i
+					}
+				}
+				pair[k] = free[min]
+				free = append(free[:min], free[min+1:]...)
+			}
+			node := len(weight)
+			weight = append(weight, weight[pair[0]]+weight[pair[1]])
+			parent[pair[0]], parent[pair[1]] = node, node
+			free = append(free, node)
+		}
+		root := len(weight) - 1
+		deepest := 0
+		for i, s := range symbols {
+			depth := 0
+			for node := i; node != root; node = parent[node] {
+				depth++
+			}
+			lengths[s] = uint8(depth)
+			if depth > deepest {
+				deepest = depth
+			}
+		}
+		if deepest <= int(maxLength) {
+			return lengths
+		}
+		for i := range weights {
+			weights[i] = (weights[i] + 1) / 2
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package ipaPng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// webpImage returns an image of width x height with noisy colors and, with
+// alpha, noisy alpha that includes fully transparent pixels.
+func webpImage(width, height int, alpha bool) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(int64(width*1000 + height)))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 0xff}
+			if alpha {
+				c.A = []uint8{0, 0x01, 0x80, 0xfe, 0xff}[rnd.Intn(5)]
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// lossyWebP returns img as EncodeWebP keeps it at quality: colors rounded
+// and those of fully transparent pixels zeroed, alpha exact.
+func lossyWebP(img *image.NRGBA, quality int) *image.NRGBA {
+	shift := uint(100-quality+24) / 25
+	want := image.NewNRGBA(img.Rect)
+	copy(want.Pix, img.Pix)
+	if shift == 0 {
+		return want
+	}
+	for i := 0; i < len(want.Pix); i += 4 {
+		p := want.Pix[i : i+4]
+		if p[3] == 0 {
+			p[0], p[1], p[2] = 0, 0, 0
+		}
+		for j := 0; j < 3; j++ {
+			p[j] = roundBits(p[j], shift)
+		}
+	}
+	return want
+}
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	flat := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for i := range flat.Pix {
+		flat.Pix[i] = 0x40
+	}
+	images := map[string]*image.NRGBA{
+		"1x1":          webpImage(1, 1, false),
+		"3x5 alpha":    webpImage(3, 5, true),
+		"64x64 flat":   flat,
+		"64x64 noise":  webpImage(64, 64, false),
+		"257x33 alpha": webpImage(257, 33, true),
+	}
+	for name, img := range images {
+		for _, quality := range []int{100, 75, 1} {
+			for _, lossless := range []bool{true, false} {
+				if lossless && quality != 100 {
+					continue
+				}
+				var b bytes.Buffer
+				if err := (&IpaPNG{Img: img}).EncodeWebP(&b, lossless, quality); err != nil {
+					t.Fatalf("%v, quality %v: %v", name, quality, err)
+				}
+				got, err := webp.Decode(&b)
+				if err != nil {
+					t.Fatalf("%v, quality %v: decode: %v", name, quality, err)
+				}
+				want := img
+				if !lossless {
+					want = lossyWebP(img, quality)
+				}
+				sameImage(t, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeWebPSize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		err           string
+	}{
+		{0, 0, "empty image of 0x0"},
+		{4, 0, "empty image of 4x0"},
+		{1<<14 + 1, 1, "too large for WebP"},
+	}
+	for _, tt := range tests {
+		img := image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height))
+		err := (&IpaPNG{Img: img}).EncodeWebP(&bytes.Buffer{}, true, 0)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%dx%d: error %v, want %q", tt.width, tt.height, err, tt.err)
+		}
+	}
+}
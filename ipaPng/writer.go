@@ -0,0 +1,582 @@
+package ipaPng
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+
+	"golang.org/x/image/tiff"
+)
+
+// defaultCgBIFlags is the CgBI chunk payload written by Xcode for RGBA images.
+const defaultCgBIFlags uint32 = 0x50002006
+
+// writeChunk writes a single chunk: length, type, data and the CRC32 of
+// type and data.
+func writeChunk(w io.Writer, cType string, data []byte) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(data)))
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, cType); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(buf[:], ChunkCRC(cType, data))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// WriteChunks writes the PNG signature followed by chunks to w, the
+// counterpart of ParseChunks. CRCs are recomputed, so chunks can be edited,
+// added or removed before reassembling a file.
+func WriteChunks(w io.Writer, chunks []*Chunk) error {
+	bw := bufio.NewWriter(w)
+	if _, err := io.WriteString(bw, pngHeader); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := c.WriteTo(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// toNRGBA returns img as an *image.NRGBA, converting it if necessary.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nRgba, ok := img.(*image.NRGBA); ok {
+		return nRgba
+	}
+	b := img.Bounds()
+	nRgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nRgba, nRgba.Bounds(), img, b.Min, draw.Src)
+	return nRgba
+}
+
+// preservedChunkTypes are the ancillary chunks of the source file that are
+// carried over when re-encoding to a standard PNG.
+var preservedChunkTypes = []string{"pHYs", "tEXt", "zTXt", "iTXt", "hIST"}
+
+// chunkInserter passes the chunks written by image/png through to w,
+// inserting before right ahead of the first IDAT chunk (so after PLTE and
+// tRNS) and after right ahead of IEND.
+type chunkInserter struct {
+	w      io.Writer
+	before []byte
+	after  []byte
+	buf    []byte // bytes of the next chunk header not yet complete
+	skip   int    // bytes of the current chunk still to pass through
+}
+
+func (ci *chunkInserter) Write(p []byte) (int, error) {
+	n := len(p)
+	if ci.buf == nil {
+		// Start by passing the signature through.
+		ci.buf, ci.skip = []byte{}, len(pngHeader)
+	}
+	for len(p) > 0 {
+		if ci.skip > 0 {
+			k := ci.skip
+			if k > len(p) {
+				k = len(p)
+			}
+			if _, err := ci.w.Write(p[:k]); err != nil {
+				return 0, err
+			}
+			ci.skip -= k
+			p = p[k:]
+			continue
+		}
+		// Collect the length and type of the next chunk.
+		k := 8 - len(ci.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		ci.buf = append(ci.buf, p[:k]...)
+		p = p[k:]
+		if len(ci.buf) < 8 {
+			break
+		}
+		var insert *[]byte
+		switch string(ci.buf[4:8]) {
+		case dsSeenIDAT:
+			insert = &ci.before
+		case dsSeenIEND:
+			insert = &ci.after
+		}
+		if insert != nil && *insert != nil {
+			if _, err := ci.w.Write(*insert); err != nil {
+				return 0, err
+			}
+			*insert = nil
+		}
+		if _, err := ci.w.Write(ci.buf); err != nil {
+			return 0, err
+		}
+		ci.skip = int(binary.BigEndian.Uint32(ci.buf[:4])) + 4
+		ci.buf = ci.buf[:0]
+	}
+	return n, nil
+}
+
+// Encode writes the decoded image to w as a standard PNG. Ancillary chunks
+// listed in preservedChunkTypes (such as pHYs) are copied from the source,
+// on the same side of IDAT they were found.
+func (cgbi *IpaPNG) Encode(w io.Writer) error {
+	return cgbi.EncodeWithOptions(w, EncodeOptions{})
+}
+
+// EncodeWithOptions is like Encode, with opts tuning the output.
+func (cgbi *IpaPNG) EncodeWithOptions(w io.Writer, opts EncodeOptions) error {
+	if cgbi.Img == nil {
+		return errors.New("no decoded image to encode")
+	}
+	if opts.IDATChunkSize < 0 {
+		return errors.New(fmt.Sprintf("invalid IDAT chunk size %v", opts.IDATChunkSize))
+	}
+	if opts.ChunkOrder != nil {
+		if err := checkChunkOrder(opts.ChunkOrder); err != nil {
+			return err
+		}
+	}
+	if opts.IDATChunkSize == 0 && opts.ChunkOrder == nil {
+		return cgbi.encode(w, cgbi.Img)
+	}
+	// Resplit or reorder the chunks of image/png at the chunk level.
+	var b bytes.Buffer
+	if err := cgbi.encode(&b, cgbi.Img); err != nil {
+		return err
+	}
+	chunks, err := ParseChunks(&b)
+	if err != nil {
+		return err
+	}
+	if opts.IDATChunkSize > 0 {
+		chunks = splitIDAT(chunks, opts.IDATChunkSize)
+	}
+	if opts.ChunkOrder != nil {
+		chunks = orderChunks(chunks, opts.ChunkOrder)
+	}
+	return WriteChunks(w, chunks)
+}
+
+// checkChunkOrder rejects an EncodeOptions.ChunkOrder without IDAT or with
+// IHDR or IEND out of place.
+func checkChunkOrder(order []string) error {
+	idat := false
+	for i, t := range order {
+		switch {
+		case t == dsSeenIDAT:
+			idat = true
+		case t == dsSeenIHDR && i != 0:
+			return errors.New("invalid chunk order: IHDR must come first")
+		case t == dsSeenIEND && i != len(order)-1:
+			return errors.New("invalid chunk order: IEND must come last")
+		}
+	}
+	if !idat {
+		return errors.New("invalid chunk order: IDAT is missing")
+	}
+	return nil
+}
+
+// orderChunks returns chunks sorted by order, as EncodeOptions.ChunkOrder
+// describes. order must have passed checkChunkOrder.
+func orderChunks(chunks []*Chunk, order []string) []*Chunk {
+	// Listed types rank at twice their index, leaving room for the
+	// unlisted ones right before IDAT and right before IEND.
+	rank := make(map[string]int, len(order))
+	for i, t := range order {
+		rank[t] = 2 * i
+	}
+	idat := rank[dsSeenIDAT]
+	end := 2 * len(order)
+	key := func(c *Chunk) int {
+		switch c.CType {
+		case dsSeenIHDR:
+			return -1
+		case dsSeenIEND:
+			return end + 1
+		}
+		if r, ok := rank[c.CType]; ok {
+			return r
+		}
+		if c.Position == PositionBeforeIDAT {
+			return idat - 1
+		}
+		return end
+	}
+	sorted := append([]*Chunk(nil), chunks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return key(sorted[i]) < key(sorted[j])
+	})
+	return sorted
+}
+
+// OutputHash returns the hex encoded SHA-256 of what Encode writes, without
+// keeping the output. The encoding is deterministic, so equal images with
+// equal ancillary chunks give equal hashes, which suits cache keys and
+// deduplication.
+func (cgbi *IpaPNG) OutputHash() (string, error) {
+	h := sha256.New()
+	if err := cgbi.Encode(h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// splitIDAT returns chunks with the data of the IDAT run cut into chunks of
+// at most size bytes.
+func splitIDAT(chunks []*Chunk, size int) []*Chunk {
+	var out []*Chunk
+	var data []byte
+	for i, c := range chunks {
+		if c.CType == dsSeenIDAT {
+			data = append(data, c.Data...)
+			if i+1 < len(chunks) && chunks[i+1].CType == dsSeenIDAT {
+				continue
+			}
+			for len(data) > size {
+				out = append(out, &Chunk{Length: uint32(size), CType: dsSeenIDAT, Data: data[:size], Position: PositionIDAT})
+				data = data[size:]
+			}
+			c = &Chunk{Length: uint32(len(data)), CType: dsSeenIDAT, Data: data, Position: PositionIDAT}
+			data = nil
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// EncodePaletted writes a paletted source back out as a paletted standard
+// PNG with its PLTE and tRNS, instead of expanding it to RGBA. The bit depth
+// is the source's (8 for images quantized from other color types), even when
+// the palette would fit in fewer bits, so the output matches the original
+// layout. Other sources are rejected; use Encode for them.
+func (cgbi *IpaPNG) EncodePaletted(w io.Writer) error {
+	paletted, ok := cgbi.Img.(*image.Paletted)
+	if !ok {
+		return errors.New(fmt.Sprintf("image with color type %v is not paletted, use Encode", cgbi.colorType))
+	}
+	depth := cgbi.depth
+	if cgbi.colorType != ctPaletted {
+		depth = 8
+	}
+	if len(paletted.Palette) > 1<<uint(depth) {
+		return errors.New(fmt.Sprintf("palette of %d colors does not fit in %d bits", len(paletted.Palette), depth))
+	}
+	return cgbi.encodeWith(w, paletted, func(w io.Writer, _ image.Image) error {
+		return encodePaletted(w, paletted, depth)
+	})
+}
+
+// encodePaletted writes img as a paletted PNG of the given bit depth, with
+// filter type None on every row. image/png picks the depth from the size of
+// the palette instead.
+func encodePaletted(w io.Writer, img *image.Paletted, depth int) error {
+	b := img.Bounds()
+	ihdr := make([]byte, iHDRLength)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(b.Dy()))
+	ihdr[8], ihdr[9] = byte(depth), ctPaletted
+	plte := make([]byte, 0, 3*len(img.Palette))
+	var trns []byte
+	for i, c := range img.Palette {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		plte = append(plte, n.R, n.G, n.B)
+		if n.A != 0xff {
+			for len(trns) < i {
+				trns = append(trns, 0xff)
+			}
+			trns = append(trns, n.A)
+		}
+	}
+
+	var idat bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&idat, zlib.BestCompression)
+	if err != nil {
+		return err
+	}
+	perByte := 8 / depth
+	row := make([]byte, 1+(b.Dx()+perByte-1)/perByte)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for i := range row {
+			row[i] = 0
+		}
+		pix := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			shift := uint(8 - depth*(x%perByte+1))
+			row[1+x/perByte] |= pix[x] << shift
+		}
+		if _, err := zw.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := io.WriteString(bw, pngHeader); err != nil {
+		return err
+	}
+	if err := writeChunk(bw, dsSeenIHDR, ihdr); err != nil {
+		return err
+	}
+	if err := writeChunk(bw, "PLTE", plte); err != nil {
+		return err
+	}
+	if trns != nil {
+		if err := writeChunk(bw, "tRNS", trns); err != nil {
+			return err
+		}
+	}
+	if err := writeChunk(bw, dsSeenIDAT, idat.Bytes()); err != nil {
+		return err
+	}
+	if err := writeChunk(bw, dsSeenIEND, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encode writes img as a standard PNG along with the preserved chunks.
+func (cgbi *IpaPNG) encode(w io.Writer, img image.Image) error {
+	return cgbi.encodeWith(w, img, png.Encode)
+}
+
+// encodeWith is encode with enc writing the PNG itself.
+func (cgbi *IpaPNG) encodeWith(w io.Writer, img image.Image, enc func(io.Writer, image.Image) error) error {
+	ownPalette := cgbi.hasOwnPalette(img)
+	var before, after bytes.Buffer
+	for _, c := range cgbi.chunks {
+		for _, t := range preservedChunkTypes {
+			if c.CType != t {
+				continue
+			}
+			// hIST describes the palette, which only survives as is when
+			// the image is written out paletted with it.
+			if c.CType == "hIST" && !ownPalette {
+				continue
+			}
+			dst := &before
+			if c.Position == PositionAfterIDAT {
+				dst = &after
+			}
+			if err := writeChunk(dst, c.CType, c.Data); err != nil {
+				return err
+			}
+		}
+	}
+	if before.Len() == 0 && after.Len() == 0 {
+		return enc(w, img)
+	}
+	return enc(&chunkInserter{w: w, before: before.Bytes(), after: after.Bytes()}, img)
+}
+
+// hasOwnPalette reports whether img is paletted with the colors of the PLTE
+// chunk of the file, and not e.g. the result of Quantize.
+func (cgbi *IpaPNG) hasOwnPalette(img image.Image) bool {
+	p, ok := img.(*image.Paletted)
+	plte := cgbi.findChunk("PLTE")
+	if !ok || plte == nil || len(plte.Data) != 3*len(p.Palette) {
+		return false
+	}
+	for i, c := range p.Palette {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		// Fully transparent entries lose their color in the conversion.
+		if n.A != 0 && (n.R != plte.Data[3*i] || n.G != plte.Data[3*i+1] || n.B != plte.Data[3*i+2]) {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodePremultipliedPNG writes the decoded image to w like Encode, but the
+// stored samples are alpha-premultiplied. This is NOT standard PNG, which
+// always stores straight alpha: ordinary viewers will show semi-transparent
+// pixels too dark. It is only meant for pipelines that upload the samples
+// as-is into premultiplied GPU textures.
+func (cgbi *IpaPNG) EncodePremultipliedPNG(w io.Writer) error {
+	if cgbi.Img == nil {
+		return errors.New("no decoded image to encode")
+	}
+	b := cgbi.Img.Bounds()
+	r := image.Rect(0, 0, b.Dx(), b.Dy())
+	// image.RGBA and image.RGBA64 hold premultiplied samples in the same
+	// layout as their non-premultiplied twins, so relabel their pixels.
+	var img image.Image
+	if cgbi.depth == 16 {
+		rgba64 := image.NewRGBA64(r)
+		draw.Draw(rgba64, r, cgbi.Img, b.Min, draw.Src)
+		img = &image.NRGBA64{Pix: rgba64.Pix, Stride: rgba64.Stride, Rect: r}
+	} else {
+		rgba := image.NewRGBA(r)
+		draw.Draw(rgba, r, cgbi.Img, b.Min, draw.Src)
+		img = &image.NRGBA{Pix: rgba.Pix, Stride: rgba.Stride, Rect: r}
+	}
+	return cgbi.encode(w, img)
+}
+
+// EncodeStream returns a reader yielding the standard PNG encoding of the
+// decoded image. The encoder runs in its own goroutine and writes into a
+// pipe, so the output can be streamed (e.g. to an HTTP response) without
+// buffering it first. An encoding error is returned by the reader's Read.
+// The caller must read until EOF or an error, or the goroutine leaks.
+func (cgbi *IpaPNG) EncodeStream() io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(cgbi.Encode(pw))
+	}()
+	return pr
+}
+
+// EncodeJPEG writes the decoded image to w as a JPEG of the given quality
+// (jpeg.DefaultQuality when 0). JPEG has no alpha channel, so transparent
+// pixels are flattened onto a white background, and 16-bit samples are
+// truncated to 8 bits. Both are recorded in Warnings when they happen.
+func (cgbi *IpaPNG) EncodeJPEG(w io.Writer, quality int) error {
+	if cgbi.Img == nil {
+		return errors.New("no decoded image to encode")
+	}
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	}
+	cgbi.warnDepth()
+	img := cgbi.Img
+	if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+		cgbi.warn("alpha flattened to white background")
+		b := img.Bounds()
+		flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+		img = flat
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+// EncodeTIFF writes the decoded image to w as a deflate compressed TIFF.
+// Unlike JPEG, TIFF is lossless and keeps the alpha channel (as unassociated
+// alpha) and 16-bit samples.
+func (cgbi *IpaPNG) EncodeTIFF(w io.Writer) error {
+	if cgbi.Img == nil {
+		return errors.New("no decoded image to encode")
+	}
+	return tiff.Encode(w, cgbi.Img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+}
+
+// warnDepth records that 16-bit samples are cut down by an 8-bit encoder.
+func (cgbi *IpaPNG) warnDepth() {
+	if cgbi.depth == 16 {
+		cgbi.warn("16-bit truncated to 8-bit")
+	}
+}
+
+// EncodeCgBI writes the decoded image back out as an Apple CgBI PNG. It is
+// the inverse of the decode transform: colors are premultiplied by alpha,
+// samples are stored as BGRA, rows use filter type None and IDAT holds a
+// raw deflate stream without zlib header or checksum. The output is always
+// 8-bit RGBA and not interlaced, so a 16-bit source is truncated, which is
+// recorded in Warnings.
+func (cgbi *IpaPNG) EncodeCgBI(w io.Writer) error {
+	return cgbi.EncodeCgBIWithOptions(w, EncodeOptions{})
+}
+
+// EncodeCgBIWithOptions is like EncodeCgBI, with opts tuning the output.
+func (cgbi *IpaPNG) EncodeCgBIWithOptions(w io.Writer, opts EncodeOptions) error {
+	if cgbi.Img == nil {
+		return errors.New("no decoded image to encode")
+	}
+	size := opts.IDATChunkSize
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid IDAT chunk size %v", size))
+	}
+	if size == 0 {
+		size = DefaultIDATChunkSize
+	}
+	cgbi.warnDepth()
+	nRgba := toNRGBA(cgbi.Img)
+	width, height := nRgba.Rect.Dx(), nRgba.Rect.Dy()
+
+	var idat bytes.Buffer
+	fw, err := flate.NewWriter(&idat, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	row := make([]byte, 1+width*4)
+	for y := 0; y < height; y++ {
+		row[0] = ftNone
+		pix := nRgba.Pix[y*nRgba.Stride : y*nRgba.Stride+width*4]
+		for x := 0; x < width*4; x += 4 {
+			a := uint32(pix[x+3])
+			row[1+x+0] = uint8((uint32(pix[x+2])*a + 127) / 255)
+			row[1+x+1] = uint8((uint32(pix[x+1])*a + 127) / 255)
+			row[1+x+2] = uint8((uint32(pix[x+0])*a + 127) / 255)
+			row[1+x+3] = pix[x+3]
+		}
+		if _, err := fw.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	flags := cgbi.CgBIFlags
+	if !cgbi.IsCgBI || flags == 0 {
+		flags = defaultCgBIFlags
+	}
+	// The colors written are premultiplied and in BGRA order, whatever
+	// the source was.
+	flags |= cgbiFlagPremultiplied | cgbiFlagBGR
+	var cgbiData [4]byte
+	binary.BigEndian.PutUint32(cgbiData[:], flags)
+
+	ihdr := make([]byte, iHDRLength)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8
+	ihdr[9] = ctTrueColorAlpha
+
+	bw := bufio.NewWriter(w)
+	if _, err := io.WriteString(bw, pngHeader); err != nil {
+		return err
+	}
+	if err := writeChunk(bw, dsSeenCgBI, cgbiData[:]); err != nil {
+		return err
+	}
+	if err := writeChunk(bw, dsSeenIHDR, ihdr); err != nil {
+		return err
+	}
+	for data := idat.Bytes(); len(data) > 0; {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := writeChunk(bw, dsSeenIDAT, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	if err := writeChunk(bw, dsSeenIEND, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,207 @@
+package ipaPng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// encodedTypes parses the file b and returns its chunk types.
+func encodedTypes(t *testing.T, b []byte) []string {
+	t.Helper()
+	chunks, err := ParseChunks(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make([]string, len(chunks))
+	for i, c := range chunks {
+		types[i] = c.CType
+	}
+	return types
+}
+
+func TestEncodeKeepsChunkPositions(t *testing.T) {
+	f := makeCgBI(testImage(3, 2), false, testChunk{"tEXt", []byte("Title\x00before")})
+	// Move a second tEXt behind IDAT.
+	chunks := splitPNG(f)
+	last := len(chunks) - 1
+	chunks = append(chunks[:last], testChunk{"tEXt", []byte("Comment\x00after")}, chunks[last])
+	cgbi := decodeBytes(t, buildPNG(chunks...), DecodeOptions{})
+
+	var b bytes.Buffer
+	if err := cgbi.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"IHDR", "tEXt", "IDAT", "tEXt", "IEND"}
+	if got := encodedTypes(t, b.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks %v, want %v", got, want)
+	}
+	out, _ := ParseChunks(bytes.NewReader(b.Bytes()))
+	if string(out[3].Data) != "Comment\x00after" || out[3].Position != PositionAfterIDAT {
+		t.Errorf("trailing tEXt %q at %v", out[3].Data, out[3].Position)
+	}
+}
+
+func TestLossyEncodeWarnings(t *testing.T) {
+	opaque := decodeBytes(t, makeCgBI(testImage(2, 2), false), DecodeOptions{})
+	if err := opaque.EncodeJPEG(ioutil.Discard, 0); err != nil {
+		t.Fatal(err)
+	}
+	if w := opaque.Warnings(); len(w) != 0 {
+		t.Errorf("opaque 8-bit JPEG: warnings %q", w)
+	}
+
+	img := image.NewNRGBA64(image.Rect(0, 0, 2, 2))
+	img.SetNRGBA64(1, 1, color.NRGBA64{0x1234, 0x5678, 0x9abc, 0x8000})
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	encoders := map[string]func(*IpaPNG) error{
+		"JPEG": func(cgbi *IpaPNG) error { return cgbi.EncodeJPEG(ioutil.Discard, 0) },
+		"WebP": func(cgbi *IpaPNG) error { return cgbi.EncodeWebP(ioutil.Discard, true, 0) },
+		"CgBI": func(cgbi *IpaPNG) error { return cgbi.EncodeCgBI(ioutil.Discard) },
+		"ICO":  func(cgbi *IpaPNG) error { return EncodeICO(ioutil.Discard, []*IpaPNG{cgbi}) },
+	}
+	for name, encode := range encoders {
+		cgbi := decodeBytes(t, b.Bytes(), DecodeOptions{})
+		if err := encode(cgbi); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		want := []string{"16-bit truncated to 8-bit"}
+		if name == "JPEG" {
+			want = append(want, "alpha flattened to white background")
+		}
+		if w := cgbi.Warnings(); !reflect.DeepEqual(w, want) {
+			t.Errorf("%v: warnings %q, want %q", name, w, want)
+		}
+	}
+
+	// TIFF keeps both.
+	cgbi := decodeBytes(t, b.Bytes(), DecodeOptions{})
+	if err := cgbi.EncodeTIFF(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if w := cgbi.Warnings(); len(w) != 0 {
+		t.Errorf("TIFF: warnings %q", w)
+	}
+}
+
+func TestEncodePalettedKeepsDepth(t *testing.T) {
+	const w, h = 5, 3
+	// Three colors, one of them half transparent: image/png would pick
+	// 2 bits for them.
+	plte := testChunk{"PLTE", []byte{0xff, 0, 0, 0, 0xff, 0, 0, 0, 0xff}}
+	trns := testChunk{"tRNS", []byte{0xff, 0x80}}
+	for _, depth := range []int{2, 4} {
+		perByte := 8 / depth
+		var raw []byte
+		for y := 0; y < h; y++ {
+			row := make([]byte, 1+(w+perByte-1)/perByte)
+			for x := 0; x < w; x++ {
+				row[1+x/perByte] |= byte((x+y)%3) << uint(8-depth*(x%perByte+1))
+			}
+			raw = append(raw, row...)
+		}
+		f := makeFile(w, h, depth, ctPaletted, 0, raw, false, plte, trns)
+		cgbi := decodeBytes(t, f, DecodeOptions{})
+		var b bytes.Buffer
+		if err := cgbi.EncodePaletted(&b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := png.Decode(bytes.NewReader(b.Bytes())); err != nil {
+			t.Errorf("depth %d: image/png: %v", depth, err)
+		}
+		out := decodeBytes(t, b.Bytes(), DecodeOptions{})
+		if out.Depth() != depth {
+			t.Errorf("depth %d written as %d", depth, out.Depth())
+		}
+		src, got := cgbi.Img.(*image.Paletted), out.Img.(*image.Paletted)
+		if !reflect.DeepEqual(got.Palette, src.Palette) {
+			t.Errorf("depth %d: palette %v, want %v", depth, got.Palette, src.Palette)
+		}
+		if !bytes.Equal(got.Pix, src.Pix) {
+			t.Errorf("depth %d: indices %v, want %v", depth, got.Pix, src.Pix)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	cgbi := decodeBytes(b, pooledTestFile(b, 512, 512), DecodeOptions{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := cgbi.Encode(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeCgBI(b *testing.B) {
+	cgbi := decodeBytes(b, pooledTestFile(b, 512, 512), DecodeOptions{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := cgbi.EncodeCgBI(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteChunks measures the chunk level writer, as used by repair.
+func BenchmarkWriteChunks(b *testing.B) {
+	chunks, err := ParseChunks(bytes.NewReader(pooledTestFile(b, 512, 512)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := WriteChunks(ioutil.Discard, chunks); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestIDATChunkSize(t *testing.T) {
+	f := pooledTestFile(t, 64, 64)
+	cgbi := decodeBytes(t, f, DecodeOptions{})
+	want := toNRGBA(cgbi.Img)
+	encoders := map[string]func(io.Writer, EncodeOptions) error{
+		"PNG":  cgbi.EncodeWithOptions,
+		"CgBI": cgbi.EncodeCgBIWithOptions,
+	}
+	for name, encode := range encoders {
+		for _, size := range []int{1, 100, 4096} {
+			var b bytes.Buffer
+			if err := encode(&b, EncodeOptions{IDATChunkSize: size}); err != nil {
+				t.Fatal(err)
+			}
+			chunks, err := ParseChunks(bytes.NewReader(b.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var n, largest int
+			for _, c := range chunks {
+				if c.CType == dsSeenIDAT {
+					n++
+					if len(c.Data) > largest {
+						largest = len(c.Data)
+					}
+				}
+			}
+			if largest != size {
+				t.Errorf("%v, size %d: largest of %d IDAT chunks holds %d bytes", name, size, n, largest)
+			}
+			sameImage(t, decodeBytes(t, b.Bytes(), DecodeOptions{}).Img, want)
+		}
+		if err := encode(ioutil.Discard, EncodeOptions{IDATChunkSize: -1}); err == nil {
+			t.Errorf("%v: negative size accepted", name)
+		}
+	}
+}
@@ -1,85 +1,709 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
 	"image/png"
-	"io/ioutil"
+	"io"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/poolqa/CgbiPngFix/ipaPng"
 )
 
 type CommandOptions struct {
-	Output string
-	Input  string
+	Output        string
+	Input         string
+	Mode          string
+	Info          bool
+	Tree          bool
+	Validate      bool
+	Dir           string
+	Ipa           string
+	List          string
+	OutDir        string
+	FailFast      bool
+	OutTemplate   string
+	OutSuffix     string
+	NoSort        bool
+	NoAtomic      bool
+	AvgColor      bool
+	BlurHash      bool
+	Hash          bool
+	KeepCgBIChunk bool
+	Recompress    bool
+	Timeout       time.Duration
+	JSONErrors    bool
+	LogFormat     string
+	ErrorReport   string
+	Mask          string
+	MaskThreshold int
+	Slice         int
+	Format        string
+	Tint          string
+	Flip          string
+	Rotate        int
+	Trim          bool
+	Verbose       bool
+	Tolerance     int
+	MaxFiles      int
+	FetchLimit    int
+	Quiet         bool
+	SuffixDims    bool
+	Comment       string
+	PaletteFrom   string
+	Sidecar       bool
+	StrictSpec    bool
+	Quality       int
+	InputBase64   string
+	OutputBase64  bool
 }
 
 var ShowHelper bool
+var ShowVersion bool
 var Options CommandOptions
 
+// Build information, set at link time with e.g.
+// -ldflags "-X main.version=v1.2.0 -X main.commit=abc1234 -X main.date=2021-03-01".
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
 func init() {
 
 	flag.BoolVar(&ShowHelper, "h", false, "show this help")
+	flag.BoolVar(&ShowVersion, "version", false, "print the version, commit and build date and exit")
 
 	// 注意 `signal`。默认是 -s string，有了 `signal` 之后，变为 -s signal
-	flag.StringVar(&Options.Output, "o", "", "set fixed png `output` file")
-	flag.StringVar(&Options.Input, "i", "", "set source ios png `input` file")
+	addInputFlags(flag.CommandLine)
+	addConvertFlags(flag.CommandLine)
+	flag.BoolVar(&Options.Info, "info", false, "print a json summary of the input file instead of converting it")
+	addInfoFlags(flag.CommandLine)
+	addBatchFlags(flag.CommandLine)
+	addOutputFlags(flag.CommandLine)
+	addCommonFlags(flag.CommandLine)
 
 	// 改变默认的 Usage，flag包中的Usage 其实是一个函数类型。这里是覆盖默认函数实现，具体见后面Usage部分的分析
 	flag.Usage = usage
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, `ios png fix version: v0.0.1
-Usage: nginx [-h] [-o filename] [-i filename]
+	fmt.Fprintf(os.Stderr, `ios png fix version: %[2]v
+Usage: %[1]v <command> [options]
+       %[1]v [options] input [output]
+       %[1]v [-h] [-version] [-o filename] [-i filename | -input-base64 data]
+               [-output-base64] [-keep-cgbi-chunk] [-timeout duration] [-m mode]
+               [-f format] [-quality n] [-suffix-dims] [-slice n]
+               [-comment text] [-palette-from file] [-sidecar] [-strict-spec]
+               [-no-atomic] [-recompress] [-json-errors] [-log-format format]
+               [-v] [-quiet] [-info] [-avgcolor] [-blurhash] [-hash]
+               [-mask filename [-mask-threshold n]] [-tint color] [-flip v|h]
+               [-rotate degrees] [-trim]
+       %[1]v [-h] (-dir directory | -list file | -ipa archive)
+               [-outdir directory | -o-template template | -output-suffix suffix]
+               [-m mode] [-f format] [-quality n] [-suffix-dims] [-comment text]
+               [-palette-from file] [-sidecar] [-strict-spec] [-no-atomic]
+               [-recompress] [-json-errors] [-log-format format] [-v] [-quiet]
+               [-fail-fast] [-no-sort] [-max-files n] [-concurrency-limit n]
+               [-error-report filename]
+
+Commands:
+`, progName(), version)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %v\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, `
+Run "%v <command> -h" for the options of a command. Without a command the
+options below select the mode, as in earlier versions.
 
 Options:
-`)
+`, progName())
 	flag.PrintDefaults()
 }
 
+// progName is the name the tool was run as, for usage texts.
+func progName() string {
+	return filepath.Base(os.Args[0])
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd := findCommand(os.Args[1]); cmd != nil {
+			cmd.flags.Parse(os.Args[2:])
+			if err := setupLogging(); err != nil {
+				log.Print(err)
+				os.Exit(exitUsage)
+			}
+			os.Exit(cmd.run(cmd.flags))
+		}
+	}
+
 	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Print(err)
+		os.Exit(exitUsage)
+	}
 
 	if ShowHelper {
 		flag.Usage()
 		os.Exit(0)
 	}
-	if Options.Input == "" {
+	if ShowVersion {
+		fmt.Printf("%v %v (commit %v, built %v)\n", progName(), version, commit, date)
+		os.Exit(0)
+	}
+	switch {
+	case Options.Dir != "" || Options.List != "" || Options.Ipa != "":
+		os.Exit(runBatch(flag.CommandLine))
+	case Options.Input == "" && Options.InputBase64 == "" && flag.NArg() == 0:
 		flag.Usage()
 		os.Exit(0)
+	case Options.Info || Options.Tree:
+		os.Exit(runInfo(flag.CommandLine))
+	default:
+		os.Exit(runConvert(flag.CommandLine))
 	}
-	doCgbiToPng(Options.Input, Options.Output)
 }
 
-func doCgbiToPng(input string, output string) {
-	f, err := os.Open(input)
+// parseMode parses the -m flag. A zero mode means "not set": the output file
+// is then created with 0666 and the process umask applies, as usual.
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q, expected octal like 644", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// parseColor parses a #rrggbb or #rrggbbaa color, as taken by -tint.
+func parseColor(s string) (color.NRGBA, error) {
+	c := color.NRGBA{A: 0xff}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return c, fmt.Errorf("invalid color %q, expected #rrggbb or #rrggbbaa", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
 	if err != nil {
-		log.Fatal(err)
+		return c, fmt.Errorf("invalid color %q, expected #rrggbb or #rrggbbaa", s)
+	}
+	if len(hex) == 6 {
+		v = v<<8 | 0xff
 	}
-	b, err := ioutil.ReadAll(f)
-	f.Close()
+	c.R, c.G, c.B, c.A = uint8(v>>24), uint8(v>>16), uint8(v>>8), uint8(v)
+	return c, nil
+}
+
+// Output formats of -f.
+const (
+	formatPNG  = "png"
+	formatJPEG = "jpeg"
+	formatTIFF = "tiff"
+	formatWebP = "webp"
+)
+
+// parseFormat checks the -f flag.
+func parseFormat(s string) (string, error) {
+	switch s {
+	case formatPNG, formatJPEG, formatTIFF, formatWebP:
+		return s, nil
+	case "jpg":
+		return formatJPEG, nil
+	case "tif":
+		return formatTIFF, nil
+	}
+	return "", fmt.Errorf("unknown output format %q, expected png, jpeg, tiff or webp", s)
+}
+
+// convertOptions controls how files are converted and written.
+type convertOptions struct {
+	mode       os.FileMode       // exact file mode, 0 to let the umask apply
+	atomic     bool              // write to a temporary file and rename it into place
+	recompress bool              // re-encode standard pngs instead of copying them
+	format     string            // output format, formatPNG, formatJPEG, formatTIFF or formatWebP
+	quality    int               // jpeg or lossy webp quality, 0 for the default
+	tint       *color.NRGBA      // multiply every pixel by this color, if set
+	flip       string            // "v" or "h" to mirror the image, applied before rotate
+	rotate     int               // rotate clockwise by 90, 180 or 270 degrees
+	trim       bool              // crop the transparent padding, after flip and rotate
+	suffixDims bool              // append _<width>x<height> to output names
+	slice      int               // split the image into this many frames, top to bottom, if set
+	written    map[string]string // outputs written so far in a batch, to their input
+	comment    string            // add a tEXt Comment chunk to png outputs, if set
+	palette    color.Palette     // map the image onto these colors, if set
+	sidecar    bool              // write the metadata of every output to <output>.json
+	strictSpec bool              // re-read png outputs and fail on PNG spec violations
+	pool       *ipaPng.BufferPool
+	read       func(input string) ([]byte, error) // read inputs with this instead of readInput, if set
+}
+
+// protectInput returns co with atomic writing turned on when output is the
+// input file itself, e.g. for -i icon.png -o icon.png. Otherwise -no-atomic
+// would truncate the input first, and an encoder failing midway would leave
+// neither the original nor a converted file.
+func protectInput(co convertOptions, input, output string) convertOptions {
+	if co.atomic {
+		return co
+	}
+	in, err := os.Stat(input)
 	if err != nil {
-		log.Fatal(err)
+		return co
 	}
+	if out, err := os.Stat(output); err == nil && os.SameFile(in, out) {
+		co.atomic = true
+	}
+	return co
+}
 
-	cgbi, err := ipaPng.Decode(bytes.NewReader(b))
+// writeFile creates path and fills it with write. In atomic mode the data
+// goes to a new temporary file in the same directory first, which is
+// renamed over path only once write succeeded, so readers never see a
+// partial file.
+func writeFile(path string, co convertOptions, write func(w io.Writer) error) error {
+	if path == "" {
+		return errors.New("no output path")
+	}
+	var fo *os.File
+	var err error
+	if co.atomic {
+		fo, err = createTemp(path)
+	} else {
+		fo, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	}
 	if err != nil {
-		fmt.Printf("err:%v\n", err)
-		log.Fatal(err)
+		return err
+	}
+	target := fo.Name()
+	// -m overrides the umask, so chmod explicitly instead of relying on OpenFile.
+	if co.mode != 0 {
+		err = fo.Chmod(co.mode)
 	}
-	fo, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE, os.FileMode(0666))
+	if err == nil {
+		err = write(fo)
+	}
+	if cerr := fo.Close(); err == nil {
+		err = cerr
+	}
+	if co.atomic {
+		if err == nil {
+			err = os.Rename(target, path)
+		}
+		if err != nil {
+			os.Remove(target)
+		}
+	}
+	return err
+}
+
+// createTemp creates a file named after path, as in icon.png.123456.tmp,
+// next to it so that renaming it over path stays on one filesystem. Like
+// ioutil.TempFile it never reuses an existing name, but it creates the file
+// with mode 0666 so that the umask applies as it would to path itself.
+func createTemp(path string) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, base+"."+strconv.FormatUint(uint64(rand.Uint32()), 10)+".tmp")
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && try < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// decodeFile reads and decodes the png file at input.
+func decodeFile(input string) (*ipaPng.IpaPNG, error) {
+	b, err := readInput(input)
 	if err != nil {
-		fmt.Printf("err:%v\n", err)
-		log.Fatal(err)
+		return nil, &ipaPng.StageError{Stage: stageRead, Err: err}
+	}
+	return ipaPng.Decode(bytes.NewReader(b))
+}
+
+func doCgbiToPng(input string, output string, co convertOptions) error {
+	start := time.Now()
+	read := readInput
+	if co.read != nil {
+		read = co.read
+	}
+	b, err := read(input)
+	if err != nil {
+		return &ipaPng.StageError{Stage: stageRead, Err: err}
+	}
+	cgbi, write, err := convert(b, co)
+	if err != nil {
+		return err
+	}
+	defer cgbi.Release()
+	img := cgbi.Img
+	frames := []image.Image{img}
+	if co.slice > 0 {
+		if frames, err = cgbi.SliceVertical(co.slice); err != nil {
+			return &ipaPng.StageError{Stage: stageWrite, Err: err}
+		}
+	}
+	for i, frame := range frames {
+		// write encodes cgbi.Img, so point it at the frame in turn.
+		cgbi.Img = frame
+		name := output
+		if co.slice > 0 {
+			name = withFrame(name, i)
+		}
+		if co.suffixDims {
+			b := frame.Bounds()
+			name = withDims(name, b.Dx(), b.Dy())
+			// Batch runs only learn the final names here, so check for
+			// clashes now.
+			if co.written != nil {
+				if prev, ok := co.written[name]; ok {
+					return &ipaPng.StageError{Stage: stageWrite, Err: fmt.Errorf("%v was already written for %v", name, prev)}
+				}
+				co.written[name] = input
+			}
+		}
+		if err = writeFile(name, protectInput(co, input, name), write); err != nil {
+			return &ipaPng.StageError{Stage: stageWrite, Err: err}
+		}
+		if co.strictSpec {
+			if err = checkSpec(name); err != nil {
+				return &ipaPng.StageError{Stage: stageSpec, Err: err}
+			}
+		}
+		if co.sidecar {
+			if err = writeSidecar(name, cgbi, co); err != nil {
+				return &ipaPng.StageError{Stage: stageWrite, Err: err}
+			}
+		}
 	}
-	defer fo.Close()
-	err = png.Encode(fo, cgbi.Img)
+	cgbi.Img = img
+	reportConverted(input, cgbi, start)
+	return nil
+}
+
+// convert decodes the png b and applies the edits of co. It returns the
+// decoded image, to be released by the caller, and the function writing it
+// out in the format of co.
+func convert(b []byte, co convertOptions) (*ipaPng.IpaPNG, func(w io.Writer) error, error) {
+	cgbi, err := ipaPng.DecodeWithOptions(bytes.NewReader(b), ipaPng.DecodeOptions{BufferPool: co.pool})
+	if err != nil {
+		return nil, nil, err
+	}
+	if co.tint != nil {
+		cgbi.Img = cgbi.Tint(*co.tint)
+	}
+	if co.flip != "" || co.rotate != 0 {
+		cgbi.Img = transform(cgbi.Img, co.flip, co.rotate)
+	}
+	if co.trim {
+		cgbi.Img = cgbi.TrimTransparent()
+	}
+	if co.palette != nil {
+		cgbi.Img = cgbi.Quantize(co.palette)
+	}
+	write := cgbi.Encode
+	switch {
+	case co.format == formatJPEG:
+		write = func(w io.Writer) error {
+			return cgbi.EncodeJPEG(w, co.quality)
+		}
+	case co.format == formatTIFF:
+		write = cgbi.EncodeTIFF
+	case co.format == formatWebP:
+		write = func(w io.Writer) error {
+			return cgbi.EncodeWebP(w, co.quality == 0, co.quality)
+		}
+	case !cgbi.IsCgBI && !co.recompress && co.tint == nil && co.flip == "" && co.rotate == 0 && !co.trim && co.slice == 0 && co.palette == nil && !isGzip(b):
+		// A standard png needs no fixing, copy it through untouched. A
+		// gzipped one is re-encoded, which takes care of decompressing it.
+		write = func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		}
+	}
+	if co.comment != "" {
+		write = withComment(write, co.comment)
+	}
+	return cgbi, write, nil
+}
+
+// checkSpec re-reads the png written to path and fails with the PNG spec
+// violations in it, for -strict-spec.
+func checkSpec(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if violations := ipaPng.CheckSpec(bufio.NewReader(f)); len(violations) > 0 {
+		return fmt.Errorf("%v breaks the PNG spec: %v", path, strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// writeSidecar writes the metadata of the output written to path, from
+// cgbi as encoded, to path+".json".
+func writeSidecar(path string, cgbi *ipaPng.IpaPNG, co convertOptions) error {
+	b, err := json.Marshal(cgbi.Metadata())
+	if err != nil {
+		return err
+	}
+	return writeFile(path+".json", co, func(w io.Writer) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	})
+}
+
+// reportConverted reports the warnings for a converted input and, with -v,
+// what was done to it. With -log-format json that is a line with the
+// details of the input and the time since start instead.
+func reportConverted(input string, cgbi *ipaPng.IpaPNG, start time.Time) {
+	reportWarnings(input, cgbi.Warnings())
+	if jsonLog() {
+		logConverted(input, cgbi, time.Since(start))
+		return
+	}
+	if Options.Verbose {
+		if cgbi.IsCgBI {
+			logInfo("%v: CgBI, un-premultiplied: %v", input, cgbi.Unpremultiplied())
+		} else {
+			logInfo("%v: standard png", input)
+		}
+	}
+}
+
+// doBase64 is doCgbiToPng for the -input-base64 and -output-base64 flags:
+// the input is read from data when it is not empty and the output is
+// printed to stdout as base64 when output is empty.
+func doBase64(input, data, output string, co convertOptions) error {
+	start := time.Now()
+	var b []byte
+	var err error
+	if data != "" {
+		// Tolerate line breaks, as in the output of base64(1).
+		b, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+	} else {
+		b, err = readInput(input)
+	}
+	if err != nil {
+		return &ipaPng.StageError{Stage: stageRead, Err: err}
+	}
+	cgbi, write, err := convert(b, co)
+	if err != nil {
+		return err
+	}
+	defer cgbi.Release()
+	if output != "" {
+		err = writeFile(output, co, write)
+	} else {
+		err = writeBase64(os.Stdout, write)
+	}
+	if err != nil {
+		return &ipaPng.StageError{Stage: stageWrite, Err: err}
+	}
+	reportConverted(input, cgbi, start)
+	return nil
+}
+
+// writeBase64 writes the output of write to w as a line of base64.
+func writeBase64(w io.Writer, write func(w io.Writer) error) error {
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if err := write(enc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// withComment wraps the png writer write to add a tEXt Comment chunk,
+// by reassembling its output chunk by chunk.
+func withComment(write func(w io.Writer) error, comment string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		var b bytes.Buffer
+		if err := write(&b); err != nil {
+			return err
+		}
+		chunks, err := ipaPng.ParseChunks(&b)
+		if err != nil {
+			return err
+		}
+		if chunks, err = ipaPng.AddText(chunks, "Comment", comment); err != nil {
+			return err
+		}
+		return ipaPng.WriteChunks(w, chunks)
+	}
+}
+
+// withDims inserts _<width>x<height> before the extension of path.
+func withDims(path string, width, height int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%v_%dx%d%v", strings.TrimSuffix(path, ext), width, height, ext)
+}
+
+// withFrame returns path with _<i> inserted before its extension, naming
+// the i-th frame of -slice.
+func withFrame(path string, i int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%v_%d%v", strings.TrimSuffix(path, ext), i, ext)
+}
+
+// transform flips img ("v" or "h") and then rotates it clockwise by the
+// given degrees.
+func transform(img image.Image, flip string, rotate int) image.Image {
+	nRgba, ok := img.(*image.NRGBA)
+	if !ok {
+		b := img.Bounds()
+		nRgba = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(nRgba, nRgba.Bounds(), img, b.Min, draw.Src)
+	}
+	switch flip {
+	case "v":
+		ipaPng.FlipVertical(nRgba)
+	case "h":
+		ipaPng.FlipHorizontal(nRgba)
+	}
+	switch rotate {
+	case 90:
+		nRgba = ipaPng.Rotate90(nRgba)
+	case 180:
+		ipaPng.FlipVertical(nRgba)
+		ipaPng.FlipHorizontal(nRgba)
+	case 270:
+		nRgba = ipaPng.Rotate90(nRgba)
+		ipaPng.FlipVertical(nRgba)
+		ipaPng.FlipHorizontal(nRgba)
+	}
+	return nRgba
+}
+
+// isGzip reports whether b is gzip compressed, which Decode handles
+// transparently.
+func isGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+type fileInfo struct {
+	IsCgBI     bool   `json:"isCgBI"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Depth      int    `json:"depth"`
+	ColorType  int    `json:"colorType"`
+	Interlace  int    `json:"interlace"`
+	HasAlpha   bool   `json:"hasAlpha"`
+	ByteOrder  string `json:"byteOrder"`
+	ChunkCount int    `json:"chunkCount"`
+	IDATSize   int    `json:"idatSize"`
+}
+
+// doInfo prints a json summary of input without writing any output file.
+func doInfo(input string) {
+	cgbi, err := decodeFile(input)
+	if err != nil {
+		fatalError(input, err)
+	}
+	info := fileInfo{
+		IsCgBI:     cgbi.IsCgBI,
+		Width:      cgbi.Width(),
+		Height:     cgbi.Height(),
+		Depth:      cgbi.Depth(),
+		ColorType:  cgbi.ColorType(),
+		Interlace:  cgbi.Interlace(),
+		HasAlpha:   cgbi.HasAlpha(),
+		ByteOrder:  cgbi.ByteOrder(),
+		ChunkCount: cgbi.ChunkCount(),
+		IDATSize:   cgbi.IDATSize(),
+	}
+	out, err := json.Marshal(info)
 	if err != nil {
-		fmt.Printf("err:%v\n", err)
 		log.Fatal(err)
 	}
+	fmt.Println(string(out))
+}
+
+// doTree prints the chunk tree of input. Only the chunks are read, so
+// files with broken image data or CRCs can be inspected too.
+func doTree(input string) {
+	b, err := readInput(input)
+	if err != nil {
+		fatalError(input, &ipaPng.StageError{Stage: stageRead, Err: err})
+	}
+	cgbi, err := ipaPng.DecodeWithOptions(bytes.NewReader(b), ipaPng.DecodeOptions{SkipIDAT: true, IgnoreCRC: true})
+	if err != nil {
+		fatalError(input, err)
+	}
+	fmt.Print(cgbi.PrintChunkTree())
+}
+
+// doAvgColor prints the alpha weighted average color of input as #rrggbbaa.
+func doAvgColor(input string) {
+	cgbi, err := decodeFile(input)
+	if err != nil {
+		fatalError(input, err)
+	}
+	c := cgbi.AverageColor()
+	fmt.Printf("#%02x%02x%02x%02x\n", c.R, c.G, c.B, c.A)
+}
+
+// doBlurHash prints the BlurHash of input, for lazy-loading placeholders.
+func doBlurHash(input string) {
+	cgbi, err := decodeFile(input)
+	if err != nil {
+		fatalError(input, err)
+	}
+	hash, err := cgbi.BlurHash(4, 3)
+	if err != nil {
+		fatalError(input, err)
+	}
+	fmt.Println(hash)
+}
+
+// doHash prints the SHA-256 of the standard png input converts to.
+func doHash(input string) {
+	cgbi, err := decodeFile(input)
+	if err != nil {
+		fatalError(input, err)
+	}
+	hash, err := cgbi.OutputHash()
+	if err != nil {
+		fatalError(input, err)
+	}
+	fmt.Println(hash)
+}
+
+// doMask writes the alpha channel of input to output as a grayscale png, or
+// as a black and white one when threshold is not -1.
+func doMask(input string, output string, threshold int, co convertOptions) error {
+	cgbi, err := decodeFile(input)
+	if err != nil {
+		return err
+	}
+	err = writeFile(output, protectInput(co, input, output), func(w io.Writer) error {
+		if threshold != -1 {
+			return png.Encode(w, cgbi.ThresholdMask(uint8(threshold)))
+		}
+		return png.Encode(w, cgbi.AlphaMask())
+	})
+	if err != nil {
+		return &ipaPng.StageError{Stage: stageWrite, Err: err}
+	}
+	return nil
 }
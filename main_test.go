@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/poolqa/CgbiPngFix/ipaPng"
+)
+
+// tempDir returns a new directory, removed at the end of the test.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cgbifix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// runConvertArgs runs the convert command on args, with fresh options.
+func runConvertArgs(args ...string) int {
+	Options = CommandOptions{}
+	cmd := newCommand("convert", "convert", runConvert, addCommonFlags, addInputFlags, addConvertFlags, addOutputFlags)
+	cmd.flags.Parse(args)
+	return cmd.run(cmd.flags)
+}
+
+// dirNames lists the names in dir.
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestConvertNeedsOutput(t *testing.T) {
+	dir := tempDir(t)
+	wd, _ := os.Getwd()
+	input, _ := filepath.Abs("testdata/icon.png")
+	// A stray .tmp where the output would have gone must survive.
+	if err := ioutil.WriteFile(filepath.Join(dir, ".tmp"), []byte("keep"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	if code := runConvertArgs("-i", input); code != exitUsage {
+		t.Errorf("exit code %d without -o, want %d", code, exitUsage)
+	}
+	if b, err := ioutil.ReadFile(".tmp"); err != nil || string(b) != "keep" {
+		t.Errorf(".tmp is %q, %v", b, err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := tempDir(t)
+	out := filepath.Join(dir, "out.png")
+	// An existing <output>.tmp is someone else's file.
+	if err := ioutil.WriteFile(out+".tmp", []byte("keep"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	write := func(s string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, s)
+			return err
+		}
+	}
+	if err := writeFile(out, convertOptions{atomic: true}, write("png")); err != nil {
+		t.Fatal(err)
+	}
+	fail := errors.New("encoder failed")
+	err := writeFile(out, convertOptions{atomic: true}, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return fail
+	})
+	if err != fail {
+		t.Fatalf("got %v, want %v", err, fail)
+	}
+	if b, _ := ioutil.ReadFile(out); string(b) != "png" {
+		t.Errorf("output is %q after a failed write", b)
+	}
+	if b, _ := ioutil.ReadFile(out + ".tmp"); string(b) != "keep" {
+		t.Errorf("out.png.tmp is %q", b)
+	}
+	if names := dirNames(t, dir); len(names) != 2 {
+		t.Errorf("temporary files left: %v", names)
+	}
+	if err := writeFile("", convertOptions{atomic: true}, write("png")); err == nil {
+		t.Error("empty path accepted")
+	}
+}
+
+func TestConvertGzip(t *testing.T) {
+	dir := tempDir(t)
+	in, out := filepath.Join(dir, "icon.png.gz"), filepath.Join(dir, "icon.png")
+	b, err := ioutil.ReadFile("testdata/icon.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// First the CgBI fixture, then the standard PNG fixed from it, which
+	// must not be copied through still gzipped.
+	for _, name := range []string{"CgBI", "standard"} {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(b)
+		zw.Close()
+		if err := ioutil.WriteFile(in, gz.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if code := runConvertArgs("-i", in, "-o", out); code != exitOK {
+			t.Fatalf("%v: exit code %d", name, code)
+		}
+		if b, err = ioutil.ReadFile(out); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := png.Decode(bytes.NewReader(b)); err != nil {
+			t.Errorf("%v: output: %v", name, err)
+		}
+	}
+}
+
+// runBatchArgs runs the batch command with args, like runConvertArgs.
+func runBatchArgs(args ...string) int {
+	Options = CommandOptions{}
+	cmd := newCommand("batch", "batch", runBatch, addCommonFlags, addBatchFlags, addOutputFlags)
+	cmd.flags.Parse(args)
+	return cmd.run(cmd.flags)
+}
+
+func TestOutDirPrecedence(t *testing.T) {
+	dir := tempDir(t)
+	in, flagDir, envDir := filepath.Join(dir, "in"), filepath.Join(dir, "flag"), filepath.Join(dir, "env")
+	for _, d := range []string{in, flagDir, envDir} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile("testdata/icon.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(in, "icon.png"), b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	old, had := os.LookupEnv(outDirEnv)
+	defer func() {
+		if had {
+			os.Setenv(outDirEnv, old)
+		} else {
+			os.Unsetenv(outDirEnv)
+		}
+	}()
+
+	tests := []struct {
+		env  string
+		args []string
+		want string
+	}{
+		{"", nil, dir},
+		{envDir, nil, envDir},
+		{envDir, []string{"-outdir", flagDir}, flagDir},
+	}
+	for _, tt := range tests {
+		os.Setenv(outDirEnv, tt.env)
+		if code := runBatchArgs(append([]string{"-dir", in}, tt.args...)...); code != exitOK {
+			t.Fatalf("env %q, %v: exit code %d", tt.env, tt.args, code)
+		}
+		out := filepath.Join(tt.want, "icon.png")
+		if _, err := os.Stat(out); err != nil {
+			t.Errorf("env %q, %v: %v", tt.env, tt.args, err)
+		}
+		os.Remove(out)
+	}
+}
+
+func TestConvertOverInputKeepsOriginal(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "wide.png")
+	// Too wide for WebP, so the encoder fails after the output was opened.
+	var b bytes.Buffer
+	if err := ipaPng.FromImage(image.NewNRGBA(image.Rect(0, 0, 16385, 1))).EncodeCgBI(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// -no-atomic doesn't apply to an output that is the input.
+	if code := runConvertArgs("-i", path, "-o", path, "-f", "webp", "-no-atomic"); code != exitFailure {
+		t.Errorf("exit code %d, want %d", code, exitFailure)
+	}
+	if got, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(got, b.Bytes()) {
+		t.Errorf("original changed: %d bytes, %v", len(got), err)
+	}
+	if names := dirNames(t, dir); len(names) != 1 {
+		t.Errorf("temporary files left: %v", names)
+	}
+}
+
+func TestIpa(t *testing.T) {
+	dir := tempDir(t)
+	icon, err := ioutil.ReadFile("testdata/icon.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "App.ipa")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	entries := []string{
+		"Payload/App.app/icon.png",
+		"Payload/App.app/Assets/icon@2x.png",
+		"Payload/App.app/Info.plist",
+		"Payload/../evil.png",
+		"Payload/App.app/../../../evil.png",
+		"Other/icon.png",
+	}
+	for _, name := range entries {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(icon)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	out := filepath.Join(dir, "out", "nested")
+	if code := runBatchArgs("-ipa", archive, "-outdir", out); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	var written []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && path != archive {
+			rel, _ := filepath.Rel(dir, path)
+			written = append(written, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	want := []string{"out/nested/App.app/Assets/icon@2x.png", "out/nested/App.app/icon.png"}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written %q, want %q", written, want)
+	}
+	for _, name := range want {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if _, err := png.Decode(bytes.NewReader(b)); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+}
+
+func TestBatchNothing(t *testing.T) {
+	dir := tempDir(t)
+	list := filepath.Join(dir, "list.txt")
+	if err := ioutil.WriteFile(list, []byte("# nothing yet\n\n   \n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if code := runBatchArgs("-dir", dir, "-outdir", out); code != exitNothing {
+		t.Errorf("-dir: exit code %d, want %d", code, exitNothing)
+	}
+	if code := runBatchArgs("-list", list, "-outdir", out); code != exitNothing {
+		t.Errorf("-list: exit code %d, want %d", code, exitNothing)
+	}
+}
+
+func TestBatchMaxFiles(t *testing.T) {
+	dir := tempDir(t)
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	if err := os.Mkdir(in, 0777); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("testdata/icon.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		if err := ioutil.WriteFile(filepath.Join(in, name), b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code := runBatchArgs("-dir", in, "-outdir", out, "-max-files", "1"); code != exitFailure {
+		t.Errorf("exit code %d, want %d", code, exitFailure)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output directory written: %v", err)
+	}
+	if code := runBatchArgs("-dir", in, "-outdir", out, "-max-files", "2"); code != exitOK {
+		t.Errorf("at the limit: exit code %d", code)
+	}
+}
+
+func TestBatchErrorReport(t *testing.T) {
+	dir := tempDir(t)
+	in := filepath.Join(dir, "in")
+	if err := os.Mkdir(in, 0777); err != nil {
+		t.Fatal(err)
+	}
+	junk := filepath.Join(in, "junk.png")
+	if err := ioutil.WriteFile(junk, []byte("not a png at all"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	report := filepath.Join(dir, "errors.csv")
+	code := runBatchArgs("-dir", in, "-outdir", filepath.Join(dir, "out"), "-error-report", report)
+	if code != exitFailure {
+		t.Errorf("exit code %d, want %d", code, exitFailure)
+	}
+	f, err := os.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || !reflect.DeepEqual(rows[0], []string{"file", "stage", "message"}) {
+		t.Fatalf("report %q, want a header and one row", rows)
+	}
+	if row := rows[1]; row[0] != junk || row[1] != ipaPng.StageSignature || row[2] == "" {
+		t.Errorf("row %q, want %v at stage %v", row, junk, ipaPng.StageSignature)
+	}
+}
+
+func TestBatchList(t *testing.T) {
+	dir := tempDir(t)
+	icon, _ := filepath.Abs("testdata/icon.png")
+	missing := filepath.Join(dir, "missing.png")
+	list := filepath.Join(dir, "list.txt")
+	content := "# icons\n\n" + icon + "\n  # indented comment\n   \n\t" + missing + "  \n"
+	if err := ioutil.WriteFile(list, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	report := filepath.Join(dir, "errors.csv")
+	if code := runBatchArgs("-list", list, "-outdir", out, "-error-report", report); code != exitFailure {
+		t.Errorf("exit code %d, want %d", code, exitFailure)
+	}
+	if names := dirNames(t, out); !reflect.DeepEqual(names, []string{"icon.png"}) {
+		t.Errorf("written %q, want the listed icon only", names)
+	}
+	// The missing file is reported with its line, after trimming.
+	b, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := list + ":6: "; !bytes.Contains(b, []byte(want)) {
+		t.Errorf("report %q does not mention %q", b, want)
+	}
+}
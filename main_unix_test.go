@@ -0,0 +1,54 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgbifix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		umask  int
+		mode   os.FileMode
+		atomic bool
+		want   os.FileMode
+	}{
+		{0022, 0, false, 0644},
+		{0022, 0, true, 0644},
+		{0002, 0, false, 0664},
+		{0002, 0, true, 0664},
+		// -m overrides the umask.
+		{0022, 0664, false, 0664},
+		{0077, 0644, true, 0644},
+	}
+	for i, tt := range tests {
+		old := syscall.Umask(tt.umask)
+		path := filepath.Join(dir, string(rune('a'+i))+".png")
+		err := writeFile(path, convertOptions{mode: tt.mode, atomic: tt.atomic}, func(w io.Writer) error {
+			_, err := io.WriteString(w, "png")
+			return err
+		})
+		syscall.Umask(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != tt.want {
+			t.Errorf("umask %o, -m %o, atomic %v: mode %o, want %o", tt.umask, tt.mode, tt.atomic, got, tt.want)
+		}
+	}
+}
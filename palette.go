@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/poolqa/CgbiPngFix/ipaPng"
+)
+
+// loadPalette reads the palette for -palette-from: a GIMP palette, named
+// *.gpl, or else the PLTE chunk of a png, with the alpha of its tRNS chunk.
+func loadPalette(path string) (color.Palette, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pal color.Palette
+	if strings.EqualFold(filepath.Ext(path), ".gpl") {
+		pal, err = parseGPL(b)
+	} else {
+		pal, err = parsePLTE(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(pal) == 0 || len(pal) > 256 {
+		return nil, fmt.Errorf("%v: a palette needs 1 to 256 colors, not %d", path, len(pal))
+	}
+	return pal, nil
+}
+
+// parseGPL parses a GIMP palette: a "GIMP Palette" line, optional Name and
+// Columns lines and comments, then a color per line as decimal red, green
+// and blue, followed by an optional name.
+func parseGPL(b []byte) (color.Palette, error) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	if !s.Scan() || strings.TrimSpace(s.Text()) != "GIMP Palette" {
+		return nil, fmt.Errorf("not a GIMP palette")
+	}
+	var pal color.Palette
+	for line := 2; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "Name:") || strings.HasPrefix(text, "Columns:") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected red, green and blue", line)
+		}
+		var rgb [3]uint8
+		for i := range rgb {
+			v, err := strconv.ParseUint(fields[i], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid color value %q", line, fields[i])
+			}
+			rgb[i] = uint8(v)
+		}
+		pal = append(pal, color.NRGBA{rgb[0], rgb[1], rgb[2], 0xff})
+	}
+	return pal, s.Err()
+}
+
+// parsePLTE returns the palette of the png b, CgBI or not.
+func parsePLTE(b []byte) (color.Palette, error) {
+	chunks, err := ipaPng.ParseChunksWithOptions(bytes.NewReader(b), ipaPng.DecodeOptions{SkipIDAT: true})
+	if err != nil {
+		return nil, err
+	}
+	var pal color.Palette
+	paletted := false
+	for _, c := range chunks {
+		switch c.CType {
+		case "IHDR":
+			paletted = len(c.Data) > 9 && c.Data[9] == 3
+		case "PLTE":
+			if len(c.Data)%3 != 0 {
+				return nil, fmt.Errorf("invalid PLTE length: %d", len(c.Data))
+			}
+			for i := 0; i+3 <= len(c.Data); i += 3 {
+				pal = append(pal, color.NRGBA{c.Data[i], c.Data[i+1], c.Data[i+2], 0xff})
+			}
+		case "tRNS":
+			// Other color types use tRNS for a single transparent color.
+			if !paletted {
+				continue
+			}
+			for i, a := range c.Data {
+				if i < len(pal) {
+					n := pal[i].(color.NRGBA)
+					n.A = a
+					pal[i] = n
+				}
+			}
+		}
+	}
+	if pal == nil {
+		return nil, fmt.Errorf("no PLTE chunk to take the palette from")
+	}
+	return pal, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadPalette(t *testing.T) {
+	dir := tempDir(t)
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	gpl := write("retro.gpl", []byte("GIMP Palette\nName: Retro\nColumns: 2\n# comment\n\n  0   0   0\tblack\n255 128 1 orange\n"))
+	want := color.Palette{color.NRGBA{0, 0, 0, 0xff}, color.NRGBA{255, 128, 1, 0xff}}
+	if pal, err := loadPalette(gpl); err != nil || !reflect.DeepEqual(pal, want) {
+		t.Errorf("gpl: got %v, %v, want %v", pal, err, want)
+	}
+
+	// A png's PLTE, with the alpha of its tRNS.
+	want = color.Palette{color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0x80}}
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewPaletted(image.Rect(0, 0, 1, 1), want)); err != nil {
+		t.Fatal(err)
+	}
+	if pal, err := loadPalette(write("pal.png", b.Bytes())); err != nil || !reflect.DeepEqual(pal, want) {
+		t.Errorf("png: got %v, %v, want %v", pal, err, want)
+	}
+
+	b.Reset()
+	png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	var many strings.Builder
+	many.WriteString("GIMP Palette\n")
+	for i := 0; i < 257; i++ {
+		many.WriteString("1 2 3\n")
+	}
+	bad := []struct {
+		name, data, want string
+	}{
+		{"short.gpl", "GIMP Palette\n1 2\n", "line 2: expected red, green and blue"},
+		{"range.gpl", "GIMP Palette\n1 2 256\n", `line 2: invalid color value "256"`},
+		{"header.gpl", "JASC-PAL\n", "not a GIMP palette"},
+		{"many.gpl", many.String(), "a palette needs 1 to 256 colors, not 257"},
+		{"rgba.png", b.String(), "no PLTE chunk to take the palette from"},
+	}
+	for _, tt := range bad {
+		_, err := loadPalette(write(tt.name, []byte(tt.data)))
+		if err == nil || !strings.HasSuffix(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestConvertPaletteFrom(t *testing.T) {
+	dir := tempDir(t)
+	gpl := filepath.Join(dir, "bw.gpl")
+	if err := ioutil.WriteFile(gpl, []byte("GIMP Palette\n0 0 0\n255 255 255\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.png")
+	if code := runConvertArgs("-i", "testdata/icon.png", "-o", out, "-palette-from", gpl); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := img.(*image.Paletted)
+	if !ok || len(p.Palette) != 2 {
+		t.Fatalf("output is %T, want a paletted image of 2 colors", img)
+	}
+}
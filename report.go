@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/poolqa/CgbiPngFix/ipaPng"
+)
+
+// Stages of the command line tool, on top of the decoding stages of ipaPng.
+const (
+	stageRead  = "read"  // reading the input file or url
+	stageWrite = "write" // encoding and writing the output file
+	stageSpec  = "spec"  // checking the output file with -strict-spec
+)
+
+// jsonError is the shape of an error printed with -json-errors.
+type jsonError struct {
+	File  string `json:"file"`
+	Stage string `json:"stage"`
+	Error string `json:"error"`
+}
+
+// jsonWarning is the shape of a warning printed with -json-errors.
+type jsonWarning struct {
+	File    string `json:"file"`
+	Warning string `json:"warning"`
+}
+
+// Values of -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logEntry is the shape of a line logged with -log-format json. A converted
+// file gets one line of level info with its details; errors, warnings and
+// other messages get their own lines.
+type logEntry struct {
+	Time       string  `json:"time"`
+	Level      string  `json:"level"`
+	File       string  `json:"file,omitempty"`
+	IsCgBI     *bool   `json:"isCgBI,omitempty"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	DurationMs float64 `json:"durationMs,omitempty"`
+	Stage      string  `json:"stage,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	Warning    string  `json:"warning,omitempty"`
+	Msg        string  `json:"msg,omitempty"`
+}
+
+// jsonLog reports whether -log-format json is set.
+func jsonLog() bool {
+	return Options.LogFormat == logFormatJSON
+}
+
+// writeLogEntry prints e to stderr as a json line, stamped with the time.
+func writeLogEntry(e logEntry) {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(b))
+}
+
+// jsonLogWriter turns what is logged through the log package, which the
+// tool only uses for errors, into json lines of level error.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	writeLogEntry(logEntry{Level: "error", Msg: strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
+
+// setupLogging applies -log-format.
+func setupLogging() error {
+	switch Options.LogFormat {
+	case logFormatText:
+	case logFormatJSON:
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	default:
+		return fmt.Errorf("invalid -log-format %q, expected text or json", Options.LogFormat)
+	}
+	return nil
+}
+
+// errorStage returns the stage err happened in, or "" if it is unknown.
+func errorStage(err error) string {
+	var se *ipaPng.StageError
+	if errors.As(err, &se) {
+		return se.Stage
+	}
+	return ""
+}
+
+// reportError prints err about file to stderr, as a json line when
+// -json-errors or -log-format json is set.
+func reportError(file string, err error) {
+	if jsonLog() {
+		writeLogEntry(logEntry{Level: "error", File: file, Stage: errorStage(err), Error: err.Error()})
+		return
+	}
+	if !Options.JSONErrors {
+		log.Printf("%v: %v", file, err)
+		return
+	}
+	b, jerr := json.Marshal(jsonError{File: file, Stage: errorStage(err), Error: err.Error()})
+	if jerr != nil {
+		log.Printf("%v: %v", file, err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(b))
+}
+
+// errorReport writes the failures of a batch run to a csv file given with
+// -error-report, with the columns file, stage and message. Every row is
+// flushed right away, so a run that crashes still leaves the rows so far.
+type errorReport struct {
+	f *os.File
+	w *csv.Writer
+}
+
+// createErrorReport creates the csv file at path and writes its header.
+func createErrorReport(path string) (*errorReport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &errorReport{f: f, w: csv.NewWriter(f)}
+	if err := r.write("file", "stage", "message"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// add writes a row for err about file. A nil report does nothing.
+func (r *errorReport) add(file string, err error) error {
+	if r == nil {
+		return nil
+	}
+	return r.write(file, errorStage(err), err.Error())
+}
+
+func (r *errorReport) write(record ...string) error {
+	r.w.Write(record)
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// Close closes the csv file. A nil report does nothing.
+func (r *errorReport) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// reportWarnings prints the non-fatal problems met while converting file to
+// stderr, as json lines when -json-errors or -log-format json is set, and
+// not at all with -quiet.
+func reportWarnings(file string, warnings []string) {
+	if Options.Quiet {
+		return
+	}
+	for _, w := range warnings {
+		if jsonLog() {
+			writeLogEntry(logEntry{Level: "warn", File: file, Warning: w})
+			continue
+		}
+		b, err := json.Marshal(jsonWarning{File: file, Warning: w})
+		if !Options.JSONErrors || err != nil {
+			log.Printf("%v: warning: %v", file, w)
+			continue
+		}
+		fmt.Fprintln(os.Stderr, string(b))
+	}
+}
+
+// logInfo logs an informational message, unless -quiet is set.
+func logInfo(format string, a ...interface{}) {
+	switch {
+	case Options.Quiet:
+	case jsonLog():
+		writeLogEntry(logEntry{Level: "info", Msg: fmt.Sprintf(format, a...)})
+	default:
+		log.Printf(format, a...)
+	}
+}
+
+// logConverted logs the line of -log-format json for an input converted in
+// elapsed, unless -quiet is set.
+func logConverted(file string, cgbi *ipaPng.IpaPNG, elapsed time.Duration) {
+	if Options.Quiet {
+		return
+	}
+	b := cgbi.Img.Bounds()
+	writeLogEntry(logEntry{
+		Level:      "info",
+		File:       file,
+		IsCgBI:     &cgbi.IsCgBI,
+		Width:      b.Dx(),
+		Height:     b.Dy(),
+		DurationMs: float64(elapsed) / float64(time.Millisecond),
+	})
+}
+
+// fatalError reports err about file and exits.
+func fatalError(file string, err error) {
+	reportError(file, err)
+	os.Exit(1)
+}